@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/gin-gonic/gin"
+)
+
+// recordingStorage records the options every object was written with
+type recordingStorage struct {
+	vod.Storage
+	mu   sync.Mutex
+	acls map[string]string
+}
+
+func (s *recordingStorage) Put(ctx context.Context, bucket, key string, data io.Reader, opts vod.PutOptions) error {
+	s.mu.Lock()
+	s.acls[key] = opts.ACL
+	s.mu.Unlock()
+	return s.Storage.Put(ctx, bucket, key, data, opts)
+}
+
+func (s *recordingStorage) Copy(ctx context.Context, sourceBucket, sourceKey, bucket, key string, opts vod.PutOptions) error {
+	s.mu.Lock()
+	s.acls[key] = opts.ACL
+	s.mu.Unlock()
+	return s.Storage.Copy(ctx, sourceBucket, sourceKey, bucket, key, opts)
+}
+
+func TestPresetVisibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-visibility-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	recorder := &recordingStorage{Storage: store, acls: map[string]string{}}
+	processor.Store = recorder
+	processor.Config.Delivery.Visibility = vod.VisibilityPrivate
+	processor.Config.Presets.Images = []vod.Preset{
+		{Name: "small", Width: 200, Height: 200, Container: "jpg", Visibility: vod.VisibilityPublic},
+		{Name: "large", Width: 720, Height: 1280, Container: "jpg"},
+	}
+
+	err = processor.ProcessImageInput(context.Background(), strings.NewReader("image"), "image/jpeg", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl := recorder.acls["catalogue/abc/small.jpg"]; acl != vod.ACLPublicRead {
+		t.Errorf("Expected public preset to be public, got %q", acl)
+	}
+	if acl := recorder.acls["catalogue/abc/large.jpg"]; acl != vod.ACLPrivate {
+		t.Errorf("Expected preset to use the configured visibility, got %q", acl)
+	}
+}
+
+func TestDuplicateVisibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-dedup-visibility-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	recorder := &recordingStorage{Storage: store, acls: map[string]string{}}
+	processor.Store = recorder
+	processor.Config.Dedup.Enabled = true
+	processor.Config.Presets.Images = []vod.Preset{
+		{Name: "small", Width: 200, Height: 200, Container: "jpg", Visibility: vod.VisibilityPrivate},
+		{Name: "large", Width: 720, Height: 1280, Container: "jpg"},
+	}
+
+	ctx := context.Background()
+	for _, root := range []string{"catalogue/abc", "catalogue/def"} {
+		err = processor.ProcessImageInput(ctx, strings.NewReader("image"), "image/jpeg", root)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The duplicate is copied from the first upload and keeps the visibility of each preset
+	if acl := recorder.acls["catalogue/def/small.jpg"]; acl != vod.ACLPrivate {
+		t.Errorf("Expected private preset to stay private when reused, got %q", acl)
+	}
+	if acl := recorder.acls["catalogue/def/large.jpg"]; acl != vod.ACLPublicRead {
+		t.Errorf("Expected public preset to stay public when reused, got %q", acl)
+	}
+}
+
+// signingStorage presigns fixed URLs on top of local storage
+type signingStorage struct {
+	*vod.LocalStorage
+}
+
+func (s signingStorage) PresignGet(ctx context.Context, bucket, key string, expires time.Duration) (string, error) {
+	return "https://storage.test/" + bucket + "/" + key, nil
+}
+
+func TestSignedURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-delivery-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := vod.NewLocalStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := vod.LoadConfig("config.json")
+	ctx := context.Background()
+	err = local.Put(ctx, config.AWS.OutputBucketName, "media/abc/720.mp4", strings.NewReader("video"), vod.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Delivery.Clients = []vod.DeliveryClient{{Token: "token", Prefixes: []string{"media/"}}}
+	processor := vod.NewProcessor(config, signingStorage{local}, nil)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	processor.CreateDeliveryServer(r)
+
+	authorization := "Bearer token"
+	get := func(key string) (*httptest.ResponseRecorder, vod.SignedURL) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/findapp/urls?key="+key, nil)
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(w, req)
+		signed := vod.SignedURL{}
+		json.Unmarshal(w.Body.Bytes(), &signed)
+		return w, signed
+	}
+
+	w, signed := get("media/abc/720.mp4")
+	if w.Code != http.StatusOK || !strings.HasSuffix(signed.URL, "/media/abc/720.mp4") || signed.ExpiresAt.Before(time.Now()) {
+		t.Fatalf("Unexpected signed URL %d %+v", w.Code, signed)
+	}
+	if w, _ = get("media/abc/missing.mp4"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected missing output to be rejected, got %d", w.Code)
+	}
+	if w, _ = get("media/../dedup/media/abc.json"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid key to be rejected, got %d", w.Code)
+	}
+	if w, _ = get("catalogue/abc/720.jpg"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected keys outside the prefixes of the client to be rejected, got %d", w.Code)
+	}
+	for _, header := range []string{"", "Bearer other", "token"} {
+		authorization = header
+		if w, _ = get("media/abc/720.mp4"); w.Code != http.StatusForbidden {
+			t.Errorf("Expected authorization %q to be rejected, got %d", header, w.Code)
+		}
+	}
+	authorization = "Bearer token"
+
+	// CloudFront URLs are signed with the configured key pair
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "cloudfront.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Delivery.CloudFront.Domain = "cdn.test"
+	config.Delivery.CloudFront.KeyPairID = "KEYPAIR"
+	config.Delivery.CloudFront.PrivateKeyPath = keyPath
+	err = config.LoadCloudFrontKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, signed = get("media/abc/720.mp4")
+	if w.Code != http.StatusOK || !strings.HasPrefix(signed.URL, "https://cdn.test/media/abc/720.mp4?") || !strings.Contains(signed.URL, "Key-Pair-Id=KEYPAIR") {
+		t.Errorf("Unexpected CloudFront URL %d %+v", w.Code, signed)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      string
+		status    int
+		transient bool
+	}{
+		{vod.ErrNotMedia, "not_media", http.StatusUnsupportedMediaType, false},
+		{fmt.Errorf("probe: %w", vod.ErrInvalidResolution), "invalid_resolution", http.StatusUnprocessableEntity, false},
+		{vod.ErrTooLarge, "too_large", http.StatusRequestEntityTooLarge, false},
+		{vod.ErrQueueFull, "queue_full", http.StatusServiceUnavailable, true},
+		{vod.ErrStorageUnavailable, "storage_unavailable", http.StatusServiceUnavailable, true},
+		{context.DeadlineExceeded, "timed_out", http.StatusGatewayTimeout, true},
+		{vod.ErrEncoderFailed, "encoder_failed", http.StatusInternalServerError, false},
+		{errors.New("unknown"), "internal", http.StatusInternalServerError, false},
+	}
+	for _, test := range tests {
+		if code := vod.ErrorCode(test.err); code != test.code {
+			t.Errorf("Expected code %s for %v, got %s", test.code, test.err, code)
+		}
+		if status := vod.ErrorStatus(test.err); status != test.status {
+			t.Errorf("Expected status %d for %v, got %d", test.status, test.err, status)
+		}
+		if transient := vod.IsTransient(test.err); transient != test.transient {
+			t.Errorf("Expected transient %v for %v", test.transient, test.err)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	config := &vod.Configuration{}
+	queue, err := vod.NewJobQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vod.CreateVideoServer(r, config, queue)
+
+	w := httptest.NewRecorder()
+	body := bytes.NewReader(bytes.Repeat([]byte("not a video "), 100))
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/findapp/gem", body))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected text upload to be rejected, got %d", w.Code)
+	}
+	response := struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "not_media" || response.Error == "" {
+		t.Errorf("Unexpected error body %s", w.Body.String())
+	}
+}
+
+func TestVideoUploadLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-limit-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.MaxUploadSize = 1024
+	queue, err := processor.NewJobQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	vod.CreateVideoServer(r, config, queue)
+
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 2048)
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, err := writer.CreateFormFile("upload", "upload.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(video))
+	writer.Close()
+	err = store.Put(context.Background(), config.AWS.InputBucketName, "media/abc/upload.mp4", strings.NewReader(video), vod.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]*http.Request{
+		"POST /gem":     httptest.NewRequest(http.MethodPost, "/findapp/gem", strings.NewReader(video)),
+		"POST /gemform": httptest.NewRequest(http.MethodPost, "/findapp/gemform", &form),
+		"PATCH /gem":    httptest.NewRequest(http.MethodPatch, "/findapp/gem?url=media/abc/upload.mp4", nil),
+	}
+	requests["POST /gemform"].Header.Set("Content-Type", writer.FormDataContentType())
+	for name, req := range requests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "too_large") {
+			t.Errorf("Expected %s larger than the maximum to be rejected, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+}
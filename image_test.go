@@ -2,24 +2,39 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
-
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	vod "eikcalb.dev/vod/src"
+	"github.com/gin-gonic/gin"
 )
 
 func TestImageResize(t *testing.T) {
 	filename := "in.png"
 	t.Log("Starting image resize test")
 	file, err := os.OpenFile(filename, os.O_RDONLY, os.ModePerm)
+	if os.IsNotExist(err) {
+		t.Skipf("Test input %s is not available", filename)
+	}
 	defer file.Close()
 	if err != nil {
 		t.Error(err.Error())
 	}
 	var out bytes.Buffer
-	err = vod.ResizeImage(file, &out, vod.NewDimension(400, 480))
+	err = vod.ResizeImage(context.Background(), file, &out, *vod.NewDimension(400, 480))
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -27,3 +42,503 @@ func TestImageResize(t *testing.T) {
 	t.Logf("Success!!")
 
 }
+
+func TestImageFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-formats-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Presets.Images = []vod.Preset{
+		{Name: "original", Codec: vod.PresetCopy, Container: "jpg"},
+		{Name: "720", Width: 720, Height: 1280, Container: "jpg", Quality: 4, Formats: []string{"webp", "avif"}},
+	}
+	err = config.Presets.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	image := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+	err = processor.ProcessImageInput(ctx, strings.NewReader(image), "image/png", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gif := "GIF89a" + strings.Repeat("\x00", 600)
+	err = processor.ProcessImageInput(ctx, strings.NewReader(gif), "image/gif", "catalogue/def")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := map[string]string{}
+	for _, root := range []string{"catalogue/abc", "catalogue/def"} {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, root+"/manifest.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := new(vod.Manifest)
+		err = json.NewDecoder(reader).Decode(manifest)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range manifest.Outputs {
+			types[entry.Key] = entry.ContentType
+		}
+	}
+
+	// Copies are named after the upload rather than the configured container
+	expected := map[string]string{
+		"catalogue/abc/original.png": "image/png",
+		"catalogue/abc/720.jpg":      "image/jpeg",
+		"catalogue/abc/720.webp":     "image/webp",
+		"catalogue/abc/720.avif":     "image/avif",
+		"catalogue/def/original.gif": "image/gif",
+		"catalogue/def/720.jpg":      "image/jpeg",
+		"catalogue/def/720.webp":     "image/webp",
+		"catalogue/def/720.avif":     "image/avif",
+	}
+	for key, contentType := range expected {
+		if types[key] != contentType {
+			t.Errorf("Expected %s to be stored as %s, got %q", key, contentType, types[key])
+		}
+	}
+	if len(types) != len(expected) {
+		t.Errorf("Unexpected outputs %v", types)
+	}
+
+	negotiated := map[string]string{
+		"image/avif,image/webp,*/*": "catalogue/abc/720.avif",
+		"image/avif;q=0,image/webp": "catalogue/abc/720.webp",
+		"image/*,*/*;q=0.8":         "catalogue/abc/720.jpg",
+	}
+	for accept, key := range negotiated {
+		if result := processor.NegotiateImage(ctx, "catalogue/abc/720.jpg", accept); result != key {
+			t.Errorf("Expected %s to negotiate %s, got %s", accept, key, result)
+		}
+	}
+	if result := processor.NegotiateImage(ctx, "catalogue/abc/original.png", "image/webp"); result != "catalogue/abc/original.png" {
+		t.Errorf("Expected missing formats to keep the output, got %s", result)
+	}
+}
+
+func TestNativeResize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-resize-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	// ffmpeg fails, so outputs can only be produced in Go
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+
+	red := color.RGBA{R: 255, A: 255}
+	source := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(source, source.Bounds(), image.NewUniform(red), image.Point{}, draw.Src)
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is padded into the box like ffmpeg did
+	var out bytes.Buffer
+	err = processor.ResizeImage(context.Background(), bytes.NewReader(encoded.Bytes()), &out, *vod.NewDimension(100, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resized, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resized.Bounds().Dx() != 100 || resized.Bounds().Dy() != 100 {
+		t.Fatalf("Expected a 100x100 image, got %v", resized.Bounds())
+	}
+	if r, g, b, _ := resized.At(50, 2).RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("Expected padding to be black")
+	}
+	if r, g, _, _ := resized.At(50, 50).RGBA(); r>>8 != 255 || g != 0 {
+		t.Errorf("Expected the image to be centered in the box")
+	}
+
+	config.Presets.Images = []vod.Preset{
+		{Name: "fit", Width: 100, Height: 100, Fit: vod.ResizeFit, Container: "png"},
+		{Name: "fill", Width: 100, Height: 100, Fit: vod.ResizeFill, Container: "jpg", Quality: 2},
+	}
+	ctx := context.Background()
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(encoded.Bytes()), "image/png", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, size := range map[string]image.Point{"catalogue/abc/fit.png": {100, 67}, "catalogue/abc/fill.jpg": {100, 100}} {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, _, err := image.Decode(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Bounds().Size() != size {
+			t.Errorf("Expected %s to be %v, got %v", key, size, output.Bounds().Size())
+		}
+		if r, g, _, _ := output.At(0, 0).RGBA(); r>>8 < 240 || g>>8 > 16 {
+			t.Errorf("Expected %s to be cropped without padding", key)
+		}
+	}
+}
+
+func TestImageMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-metadata-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Privacy.StripMetadata = true
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+	config.Presets.Images = []vod.Preset{
+		{Name: "original", Codec: vod.PresetCopy, Container: "jpg"},
+		{Name: "small", Width: 10, Height: 10, Fit: vod.ResizeFit, Container: "jpg", Quality: 2},
+	}
+
+	// The photo is stored sideways, red on the left, and displayed upright with red on top
+	source := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(source, image.Rect(0, 0, 20, 20), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(source, image.Rect(20, 0, 40, 20), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, source, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo := append([]byte{0xFF, 0xD8}, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), testExif()...))...)
+	photo = append(photo, jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01testprofile"))...)
+	photo = append(photo, encoded.Bytes()[2:]...)
+
+	ctx := context.Background()
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(photo), "image/jpeg", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := map[string][]byte{}
+	for _, key := range []string{"catalogue/abc/original.jpg", "catalogue/abc/small.jpg"} {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[key], _ = ioutil.ReadAll(reader)
+		reader.Close()
+		if bytes.Contains(outputs[key], []byte("SERIAL123")) || bytes.Contains(outputs[key], []byte("Phone")) {
+			t.Errorf("Expected %s to be stripped of private metadata", key)
+		}
+		if !bytes.Contains(outputs[key], []byte("testprofile")) {
+			t.Errorf("Expected %s to keep the color profile", key)
+		}
+	}
+	if !bytes.Contains(outputs["catalogue/abc/original.jpg"], []byte("Exif")) {
+		t.Errorf("Expected the original to keep its orientation")
+	}
+	small, err := jpeg.Decode(bytes.NewReader(outputs["catalogue/abc/small.jpg"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.Bounds().Size() != image.Pt(5, 10) {
+		t.Fatalf("Expected the resized image to be upright, got %v", small.Bounds().Size())
+	}
+	if r, _, b, _ := small.At(2, 1).RGBA(); r < b {
+		t.Errorf("Expected the top of the image to be red")
+	}
+	if r, _, b, _ := small.At(2, 8).RGBA(); b < r {
+		t.Errorf("Expected the bottom of the image to be blue")
+	}
+
+	reader, err := store.Get(ctx, config.AWS.OutputBucketName, "catalogue/abc/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	manifest := new(vod.Manifest)
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := manifest.Metadata
+	if meta == nil || meta.Make != "Phone" || meta.Model != "X1" || meta.Orientation != 6 || !meta.ColorProfile {
+		t.Fatalf("Unexpected metadata %+v", meta)
+	}
+	if meta.Width != 20 || meta.Height != 40 {
+		t.Errorf("Expected the display size in metadata, got %dx%d", meta.Width, meta.Height)
+	}
+}
+
+func TestStripMetadataFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-strip-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Privacy.StripMetadata = true
+	config.Dedup.Enabled = false
+	ctx := context.Background()
+	output := func(root, container string) []byte {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, root+"/original."+container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, _ := ioutil.ReadAll(reader)
+		return data
+	}
+
+	// Images appended after the end of a JPEG, as a multi picture segment points to, hold metadata of their own
+	source := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo := append([]byte{0xFF, 0xD8}, jpegSegment(0xE2, []byte("MPF\x00preview"))...)
+	photo = append(photo, encoded.Bytes()[2:]...)
+	photo = append(photo, []byte("\xFF\xD8appended SERIAL123\xFF\xD9")...)
+	config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "jpg"}}
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(photo), "image/jpeg", "catalogue/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := output("catalogue/jpeg", "jpg"); bytes.Contains(data, []byte("SERIAL123")) || !bytes.HasSuffix(data, []byte{0xFF, 0xD9}) {
+		t.Errorf("Expected the JPEG to end with its image")
+	}
+
+	// A simple WebP file cannot hold EXIF data, which is only valid in the extended format
+	riff := func(chunks ...string) []byte {
+		data := "WEBP" + strings.Join(chunks, "")
+		size := len(data)
+		return append([]byte{'R', 'I', 'F', 'F', byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)}, data...)
+	}
+	chunk := func(kind string, payload []byte) string {
+		size := len(payload)
+		data := kind + string([]byte{byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)}) + string(payload)
+		if size%2 == 1 {
+			data += "\x00"
+		}
+		return data
+	}
+	exif := chunk("EXIF", testExif())
+	config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "webp"}}
+	simple := riff(chunk("VP8L", []byte("\x2f\x00\x00\x00\x00")), exif)
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(simple), "image/webp", "catalogue/simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := output("catalogue/simple", "webp"); bytes.Contains(data, []byte("EXIF")) {
+		t.Errorf("Expected a simple WebP file to have no EXIF chunk")
+	}
+	extended := riff(chunk("VP8X", []byte("\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00")), chunk("VP8L", []byte("\x2f\x00\x00\x00\x00")), exif)
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(extended), "image/webp", "catalogue/extended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := output("catalogue/extended", "webp")
+	if !bytes.Contains(data, []byte("EXIF")) || bytes.Contains(data, []byte("SERIAL123")) || data[20]&0x08 == 0 {
+		t.Errorf("Expected an extended WebP file to keep only its orientation")
+	}
+
+	// A color profile which inflates beyond the maximum is ignored rather than read into memory
+	encoded.Reset()
+	err = png.Encode(&encoded, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile bytes.Buffer
+	writer := zlib.NewWriter(&profile)
+	writer.Write(make([]byte, 8<<20))
+	writer.Close()
+	payload := append([]byte("icc\x00\x00"), profile.Bytes()...)
+	iccp := append([]byte{byte(len(payload) >> 24), byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload))}, "iCCP"...)
+	iccp = append(iccp, payload...)
+	crc := crc32.ChecksumIEEE(iccp[4:])
+	iccp = append(iccp, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	header := 8 + 25
+	picture := append(append(append([]byte(nil), encoded.Bytes()[:header]...), iccp...), encoded.Bytes()[header:]...)
+	config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "png"}}
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(picture), "image/png", "catalogue/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := store.Get(ctx, config.AWS.OutputBucketName, "catalogue/png/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	manifest := new(vod.Manifest)
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Metadata == nil || manifest.Metadata.ColorProfile {
+		t.Errorf("Expected the oversized color profile to be skipped, got %+v", manifest.Metadata)
+	}
+}
+
+// testExif returns little endian EXIF data with a camera, an orientation, a GPS directory and a serial number
+func testExif() []byte {
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	entry := func(tag, kind uint16, count, value uint32) {
+		data = append(data, byte(tag), byte(tag>>8), byte(kind), byte(kind>>8))
+		data = append(data, byte(count), byte(count>>8), byte(count>>16), byte(count>>24))
+		data = append(data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+	}
+	data = append(data, 5, 0)
+	entry(0x010F, 2, 6, 74)
+	entry(0x0110, 2, 3, uint32('X')|uint32('1')<<8)
+	entry(0x0112, 3, 1, 6)
+	entry(0x8825, 4, 1, 90)
+	entry(0xA431, 2, 10, 80)
+	data = append(data, 0, 0, 0, 0)
+	data = append(data, "Phone\x00SERIAL123\x00"...)
+	return append(data, 0, 0, 0, 0, 0, 0)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	size := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(size >> 8), byte(size)}, payload...)
+}
+
+func TestCropModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-crop-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, _ := newTestProcessor(t, dir)
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+
+	// A gray photo with a face on the left and a detailed pattern on the right
+	gray := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	source := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	draw.Draw(source, source.Bounds(), image.NewUniform(gray), image.Point{}, draw.Src)
+	draw.Draw(source, image.Rect(20, 20, 80, 80), image.NewUniform(color.RGBA{R: 224, G: 172, B: 140, A: 255}), image.Point{}, draw.Src)
+	for y := 0; y < 100; y++ {
+		for x := 200; x < 300; x++ {
+			if (x/4+y/4)%2 == 0 {
+				source.Set(x, y, color.Black)
+			} else {
+				source.Set(x, y, color.White)
+			}
+		}
+	}
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resize := func(d vod.Dimension) image.Image {
+		var out bytes.Buffer
+		err := processor.ResizeImage(context.Background(), bytes.NewReader(encoded.Bytes()), &out, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resized, err := png.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resized
+	}
+	square := *vod.NewDimension(100, 100)
+	isGray := func(c color.Color) bool {
+		r, g, b, _ := c.RGBA()
+		return r>>8 > 100 && r>>8 < 156 && r == g && g == b
+	}
+
+	if center := resize(square.Fit(vod.ResizeFill)); !isGray(center.At(50, 50)) {
+		t.Errorf("Expected fill to crop around the center")
+	}
+	if attention := resize(square.Fit(vod.ResizeCover).Focus(vod.FocusAttention)); isGray(attention.At(50, 50)) {
+		t.Errorf("Expected attention to keep the face in frame")
+	} else if r, g, b, _ := attention.At(50, 50).RGBA(); r <= g || g <= b {
+		t.Errorf("Expected attention to center the face, got %v", attention.At(50, 50))
+	}
+	for _, focus := range []vod.CropFocus{vod.FocusEntropy, vod.NewFocalPoint(0.9, 0.5)} {
+		cropped := resize(square.Fit(vod.ResizeFill).Focus(focus))
+		if !isGray(cropped.At(50, 50)) && !isGray(cropped.At(90, 10)) {
+			continue
+		}
+		t.Errorf("Expected %s to keep the pattern in frame", focus)
+	}
+
+	if stretched := resize(vod.NewDimension(50, 50).Fit(vod.ResizeStretch)); stretched.Bounds().Size() != image.Pt(50, 50) {
+		t.Errorf("Expected stretch to fill the box, got %v", stretched.Bounds().Size())
+	}
+	if padded := resize(square.Background("#ffffff")); padded.Bounds().Size() != image.Pt(100, 100) {
+		t.Errorf("Expected pad to fill the box, got %v", padded.Bounds().Size())
+	} else if r, g, b, _ := padded.At(50, 2).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 {
+		t.Errorf("Expected padding to be white")
+	}
+	if blurred := resize(square.Background(vod.BackgroundBlur)); !isGray(blurred.At(50, 2)) {
+		t.Errorf("Expected padding to blur the photo, got %v", blurred.At(50, 2))
+	}
+
+	err = processor.ResizeImage(context.Background(), bytes.NewReader(encoded.Bytes()), ioutil.Discard, square.Fit("zoom"))
+	if vod.ErrorCode(err) != "invalid_request" {
+		t.Errorf("Expected an unknown mode to be rejected, got %v", err)
+	}
+}
+
+func TestCatalogueLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-catalogue-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, _ := newTestProcessor(t, dir)
+	probing := processor.Encoder
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+	processor.Config.Presets.Images = []vod.Preset{{Name: "small", Width: 10, Height: 10, Container: "png"}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	processor.CreateImageServer(r)
+	post := func(size int) int {
+		var encoded bytes.Buffer
+		err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, size, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/findapp/catalogue", &encoded))
+		return w.Code
+	}
+
+	// Images shorter than the bytes used to detect their type are accepted
+	if code := post(1); code != http.StatusOK {
+		t.Errorf("Expected a small image to be accepted, got %d", code)
+	}
+	processor.Config.MaxImagePixels = 100 * 100
+	if code := post(101); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an image with too many pixels to be rejected, got %d", code)
+	}
+	processor.Config.MaxUploadSize = 10
+	if code := post(1); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an upload larger than the maximum to be rejected, got %d", code)
+	}
+
+	// The size of images Go cannot decode is probed, and they are rejected when it cannot be
+	webp := "RIFF\x0c\x00\x00\x00WEBPVP8 \x00\x00\x00\x00"
+	err = processor.ProcessImageInput(context.Background(), strings.NewReader(webp), "image/webp", "catalogue/unknown")
+	if vod.ErrorCode(err) != "encoder_failed" {
+		t.Errorf("Expected an image which cannot be probed to be rejected, got %v", err)
+	}
+	processor.Encoder = probing
+	err = processor.ProcessImageInput(context.Background(), strings.NewReader(webp), "image/webp", "catalogue/large")
+	if vod.ErrorCode(err) != "too_large" {
+		t.Errorf("Expected a probed image with too many pixels to be rejected, got %v", err)
+	}
+}
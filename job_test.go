@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/gin-gonic/gin"
+)
+
+func TestJobStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	queue, err := vod.NewJobQueue(&vod.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vod.CreateJobServer(r, queue)
+
+	job := vod.NewVideoJob("", "missing-upload.mp4", "video/mp4", []string{vod.OutputMP4})
+	err = queue.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := new(vod.Job)
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/findapp/jobs/"+job.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", w.Code)
+		}
+		err = json.Unmarshal(w.Body.Bytes(), status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == vod.JobFailed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.State != vod.JobFailed || status.Error == "" || status.MediaID != job.MediaID {
+		t.Errorf("Expected job with missing input to fail, got %+v", status)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/findapp/jobs/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown job to be missing, got %d", w.Code)
+	}
+}
+
+func TestJobStoreResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-jobs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := vod.NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := vod.NewVideoJob("media/abc/upload.mp4", filepath.Join(dir, "missing-upload.mp4"), "video/mp4", []string{vod.OutputHLS})
+	err = store.Save(interrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &vod.Configuration{}
+	config.Jobs.Path = dir
+	queue, err := vod.NewJobQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, ok := queue.Get(interrupted.ID)
+	if !ok {
+		t.Fatal("Expected stored job to be loaded")
+	}
+	status := job.Snapshot()
+	if status.State != vod.JobFailed || status.InputKey != "media/abc/upload.mp4" || len(status.Outputs) != 1 {
+		t.Errorf("Expected interrupted job to be marked as failed, got %+v", status)
+	}
+
+	jobs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].State != vod.JobFailed {
+		t.Errorf("Expected failure to be recorded, got %d jobs", len(jobs))
+	}
+}
+
+func TestJobStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-jobs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := vod.NewJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := vod.NewVideoJob("", "", "video/mp4", []string{vod.OutputMP4})
+	finished.State = vod.JobDone
+	finished.UpdatedAt = time.Now().Add(-48 * time.Hour)
+	err = store.Save(finished)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More jobs are resumed than the queue holds, and wait for room instead of failing
+	var resumed []*vod.Job
+	for i := 0; i < 3; i++ {
+		input, err := ioutil.TempFile(store.UploadDir(), "upload-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.Close()
+		job := vod.NewVideoJob("", input.Name(), "video/mp4", []string{vod.OutputMP4})
+		err = store.Save(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed = append(resumed, job)
+	}
+
+	config := &vod.Configuration{}
+	config.Jobs.Path = dir
+	config.Jobs.QueueSize = 1
+	queue, err := vod.NewJobQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queue.Get(finished.ID); ok {
+		t.Errorf("Expected a job which ended before the retention to be forgotten")
+	}
+	if _, err := os.Stat(filepath.Join(dir, finished.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the record of a forgotten job to be removed, got %v", err)
+	}
+	for _, stored := range resumed {
+		job, ok := queue.Get(stored.ID)
+		if !ok {
+			t.Fatalf("Expected job %s to be resumed", stored.ID)
+		}
+		for i := 0; i < 100 && job.Snapshot().State != vod.JobFailed; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// The staged inputs are not videos, so the jobs are processed and fail
+		if status := job.Snapshot(); status.State != vod.JobFailed || status.ErrorCode == "queue_full" {
+			t.Errorf("Expected job %s to be processed, got %+v", stored.ID, status)
+		}
+	}
+}
+
+// blockingStorage holds reads until it is released
+type blockingStorage struct {
+	vod.Storage
+	release chan struct{}
+}
+
+func (s *blockingStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	<-s.release
+	return s.Storage.Get(ctx, bucket, key)
+}
+
+func TestJobQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-jobs-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	// The worker looks for duplicates of the first job until reads are released, so the queue fills up
+	blocking := &blockingStorage{Storage: store, release: make(chan struct{})}
+	defer close(blocking.release)
+	processor.Store = blocking
+	processor.Config.Dedup.Enabled = true
+	processor.Config.Jobs.Path = filepath.Join(dir, "jobs")
+	processor.Config.Jobs.QueueSize = 1
+	queue, err := processor.NewJobQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rejected *vod.Job
+	for i := 0; i < 5 && rejected == nil; i++ {
+		input, err := ioutil.TempFile(dir, "upload-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.Close()
+		job := vod.NewVideoJob("", input.Name(), "video/mp4", []string{vod.OutputMP4})
+		job.Checksum = "checksum"
+		err = queue.Enqueue(job)
+		if err == vod.ErrQueueFull {
+			rejected = job
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rejected == nil {
+		t.Fatal("Expected the queue to fill up")
+	}
+	jobStore, err := vod.NewJobStore(processor.Config.Jobs.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := jobStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if job.ID == rejected.ID {
+			t.Errorf("Expected the rejected job not to be recorded")
+		}
+	}
+	if len(jobs) == 0 {
+		t.Errorf("Expected the accepted jobs to be recorded")
+	}
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	vod "eikcalb.dev/vod/src"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/h2non/filetype"
 )
 
 func setupRouter(config *vod.Configuration) *gin.Engine {
@@ -32,41 +41,235 @@ func setupRouter(config *vod.Configuration) *gin.Engine {
 	return r
 }
 
-func setupLambda(ctx context.Context, event events.S3Event) error {
-	for _, record := range event.Records {
-		if record.S3.Bucket.Name != vod.Config.AWS.InputBucketName {
-			return fmt.Errorf("Cannot process requests for this bucket(%s)", record.S3.Bucket.Name)
+// lambdaCleanupMargin is the time kept before the lambda deadline to stop ffmpeg and remove temporary files
+const lambdaCleanupMargin = 10 * time.Second
+
+// lambdaHandler returns the lambda handler which processes S3 events with the processor
+func lambdaHandler(processor *vod.Processor) func(context.Context, events.S3Event) error {
+	return func(ctx context.Context, event events.S3Event) error {
+		return setupLambda(ctx, processor, event)
+	}
+}
+
+func setupLambda(ctx context.Context, processor *vod.Processor, event events.S3Event) error {
+	config := processor.Config
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-lambdaCleanupMargin))
+		defer cancel()
+	}
+
+	// Lambda may be frozen once the handler returns, so webhooks are delivered before
+	defer func() {
+		err := processor.Webhooks.Wait(ctx)
+		if err != nil {
+			log.Printf("Webhook deliveries did not complete: %s", err.Error())
 		}
+	}()
+
+	// Lambda retries the whole event when an error is returned, which only helps transient failures.
+	// Other failures are logged and the remaining records are still processed.
+	var retry error
+	for _, record := range event.Records {
+		key := record.S3.Object.Key
+		var handle func(context.Context, events.S3Entity) error
 		switch {
-		case strings.HasPrefix(record.S3.Object.Key, vod.Config.AWS.CataloguePrefixName):
-			err := vod.HandleAWSCatalogue(record.S3)
-			if err != nil {
-				return err
-			}
-		case strings.HasPrefix(record.S3.Object.Key, vod.Config.AWS.MediaPrefixName):
-			err := vod.HandleAWSMedia(record.S3)
-			if err != nil {
-				return err
-			}
+		case record.S3.Bucket.Name != config.AWS.InputBucketName:
+			log.Printf("Cannot process requests for this bucket(%s)", record.S3.Bucket.Name)
+			continue
+		case strings.HasPrefix(key, config.AWS.CataloguePrefixName):
+			handle = processor.HandleAWSCatalogue
+		case strings.HasPrefix(key, config.AWS.MediaPrefixName):
+			handle = processor.HandleAWSMedia
+		default:
+			continue
+		}
+
+		processor.NotifyUpload(vod.WebhookJobAccepted, key, nil)
+		err := handle(ctx, record.S3)
+		if err == nil {
+			processor.NotifyUpload(vod.WebhookJobCompleted, key, nil)
+			continue
+		}
+		log.Printf("Failed to process %s(%s): %s", key, vod.ErrorCode(err), err.Error())
+		processor.NotifyUpload(vod.WebhookJobFailed, key, err)
+		if vod.IsTransient(err) {
+			retry = err
 		}
 	}
-	return nil
+	return retry
 }
 
-func serverMain() {
-	r := setupRouter(vod.Config)
+func serverMain(processor *vod.Processor) {
+	config := processor.Config
+	r := setupRouter(config)
 
 	// Register middleware routers
-	vod.CreateVideoServer(r, vod.Config)
-	vod.CreateImageServer(r)
+	queue, err := processor.NewJobQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+	vod.CreateVideoServer(r, config, queue)
+	processor.CreateImageServer(r)
+	processor.CreateProbeServer(r)
+	processor.CreateUploadServer(r)
+	processor.CreateDeliveryServer(r)
+	cache, err := processor.NewImageCache()
+	if err != nil {
+		log.Fatal(err)
+	}
+	processor.CreateTransformServer(r, cache)
+	vod.CreateJobServer(r, queue)
+	tus, err := processor.NewTusStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	vod.CreateTusServer(r, queue, tus)
 
-	log.Printf("Starting %s server!\n========\tUsing address %s:%v\t=========", vod.Config.AppName, vod.Config.Listen.Host, vod.Config.Listen.Port)
-	err := r.Run(fmt.Sprintf("%s:%s", vod.Config.Listen.Host, strconv.Itoa(vod.Config.Listen.Port)))
+	log.Printf("Starting %s server!\n========\tUsing address %s:%v\t=========", config.AppName, config.Listen.Host, config.Listen.Port)
+	err = r.Run(fmt.Sprintf("%s:%s", config.Listen.Host, strconv.Itoa(config.Listen.Port)))
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+const usage = `Usage: vod [-config path] <command> [arguments]
+
+Commands:
+  serve           start the HTTP server
+  lambda          handle S3 events as an AWS Lambda function (default)
+  process <file>  process an image or video and store its outputs
+  probe <file>    print the container and stream information of a media file
+`
+
 func main() {
-	lambda.Start(setupLambda)
+	configPath := flag.String("config", "config.json", "path to the configuration file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	// Lambda runs the binary without arguments
+	command := flag.Arg(0)
+	if command == "" {
+		command = "lambda"
+	}
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	switch command {
+	case "serve", "lambda", "process", "probe":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (command == "process" || command == "probe") && len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	processor, err := vod.NewProcessorFromConfig(vod.LoadConfig(*configPath))
+	if err != nil {
+		log.Fatal("Cannot continue without storage backend: ", err)
+	}
+
+	switch command {
+	case "serve":
+		serverMain(processor)
+	case "lambda":
+		lambda.Start(lambdaHandler(processor))
+	case "process":
+		err = processMain(processor, args[0])
+	case "probe":
+		err = probeMain(processor, args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// commandContext returns a context which is cancelled on interrupt, so that ffmpeg is stopped with the command
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// processMain processes a local image or video and prints where its outputs were stored
+func processMain(processor *vod.Processor, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := file.Read(head)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	file.Seek(0, 0)
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	isVideoType, contentType := vod.IsVideo(head)
+	switch {
+	case isVideoType || filetype.IsVideo(head):
+		destinationRoot := processor.MediaRoot(uuid.New().String())
+		err = processor.ProcessVideoFile(ctx, file, contentType, destinationRoot)
+		if err != nil {
+			return err
+		}
+		fmt.Println(destinationRoot)
+	case strings.HasPrefix(contentType, "image") || filetype.IsImage(head):
+		// IsVideo names undetected content video/mp4, so images are detected again
+		contentType = http.DetectContentType(head)
+		if !strings.HasPrefix(contentType, "image") {
+			kind, _ := filetype.Match(head)
+			contentType = kind.MIME.Value
+		}
+		destinationRoot := processor.CatalogueRoot(uuid.New().String())
+		err = processor.ProcessImageInput(ctx, file, contentType, destinationRoot)
+		if err != nil {
+			return err
+		}
+		fmt.Println(destinationRoot)
+	default:
+		return fmt.Errorf("Cannot process %s, it is not an image or video", path)
+	}
+	return nil
+}
+
+// probeMain prints the probe result of a local media file as JSON
+func probeMain(processor *vod.Processor, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	info, err := processor.Probe(ctx, file)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(info)
 }
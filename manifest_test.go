@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-manifest-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Dedup.Enabled = true
+
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	for _, key := range []string{"media/abc/upload.mp4", "media/def/upload.mp4"} {
+		err = store.Put(ctx, config.AWS.InputBucketName, key, strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = processor.HandleAWSMedia(ctx, events.S3Entity{Object: events.S3Object{Key: key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checksum := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	expected := map[string]struct {
+		preset   string
+		width    int
+		size     int64
+		checksum string
+	}{
+		"1080.mp4":  {"1080p", 1080, int64(len(video)), checksum(video)},
+		"720.mp4":   {"720p", 720, 7, checksum("encoded")},
+		"thumb.png": {"thumb", 600, 7, checksum("encoded")},
+	}
+
+	// The duplicate lists its own copies of the outputs
+	for _, root := range []string{"media/abc", "media/def"} {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, root+"/manifest.json")
+		if err != nil {
+			t.Fatalf("Expected manifest under %s, got %v", root, err)
+		}
+		manifest := new(vod.Manifest)
+		err = json.NewDecoder(reader).Decode(manifest)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Root != root {
+			t.Errorf("Expected manifest root %s, got %s", root, manifest.Root)
+		}
+
+		entries := map[string]vod.ManifestEntry{}
+		for _, entry := range manifest.Outputs {
+			entries[entry.Key] = entry
+		}
+		if _, ok := entries[root+"/metadata.json"]; !ok {
+			t.Errorf("Expected metadata in manifest of %s", root)
+		}
+		for name, output := range expected {
+			entry, ok := entries[root+"/"+name]
+			if !ok {
+				t.Errorf("Expected %s/%s in manifest", root, name)
+				continue
+			}
+			if entry.Preset != output.preset || entry.Width != output.width || entry.Size != output.size || entry.Checksum != output.checksum {
+				t.Errorf("Unexpected manifest entry for %s/%s: %+v", root, name, entry)
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+// fakeEncoder stands in for ffmpeg and writes a fixed output for every encode, to the file named last when it is not a pipe
+const fakeEncoder = `#!/bin/sh
+for last; do :; done
+if [ "$last" = "pipe:1" ]; then
+	printf 'encoded'
+else
+	printf 'encoded' > "$last"
+fi
+`
+
+func TestProcessorStreamsOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-pipeline-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	err = store.Put(ctx, config.AWS.InputBucketName, "media/abc/upload.mp4", strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity := events.S3Entity{Object: events.S3Object{Key: "media/abc/upload.mp4"}}
+	err = processor.HandleAWSMedia(ctx, entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"media/abc/1080.mp4":      video,
+		"media/abc/720.mp4":       "encoded",
+		"media/abc/thumb.png":     "encoded",
+		"media/abc/1080.jpg":      "encoded",
+		"media/abc/720.jpg":       "encoded",
+		"media/abc/metadata.json": "",
+	}
+	for key, data := range expected {
+		reader, err := store.Get(ctx, config.AWS.OutputBucketName, key)
+		if err != nil {
+			t.Errorf("Expected %s to be stored, got %v", key, err)
+			continue
+		}
+		stored, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if data != "" && string(stored) != data {
+			t.Errorf("Unexpected data stored at %s: %q", key, stored)
+		}
+	}
+}
+
+func TestProcessorReusesDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-dedup-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Dedup.Enabled = true
+
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	for _, key := range []string{"media/abc/upload.mp4", "media/def/upload.mp4"} {
+		err = store.Put(ctx, config.AWS.InputBucketName, key, strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = processor.HandleAWSMedia(ctx, events.S3Entity{Object: events.S3Object{Key: "media/abc/upload.mp4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encoding the duplicate would fail
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+	err = processor.HandleAWSMedia(ctx, events.S3Entity{Object: events.S3Object{Key: "media/def/upload.mp4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := store.Get(ctx, config.AWS.OutputBucketName, "media/def/720.mp4")
+	if err != nil {
+		t.Fatalf("Expected outputs to be reused, got %v", err)
+	}
+	defer reader.Close()
+	stored, _ := ioutil.ReadAll(reader)
+	if string(stored) != "encoded" {
+		t.Errorf("Unexpected data stored for duplicate: %q", stored)
+	}
+}
+
+// newTestProcessor returns a processor with local storage and fake encoders under dir
+func newTestProcessor(t *testing.T, dir string) (*vod.Processor, vod.Storage) {
+	bin := filepath.Join(dir, "bin")
+	err := os.Mkdir(bin, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(fakeEncoder), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(bin, "ffprobe"), []byte(fakeFFprobe), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := vod.NewLocalStorage(filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := vod.LoadConfig("config.json")
+	config.Video.Outputs = []string{vod.OutputMP4}
+	config.Video.Metadata = true
+	config.Presets = vod.DefaultPresets
+	// The pipeline is tested with the transcode, which is disabled by default
+	enabled := true
+	config.Presets.Videos = append([]vod.Preset(nil), config.Presets.Videos...)
+	config.Presets.Videos[1].Enabled = &enabled
+	encoder := vod.CommandEncoder{FFmpegPath: filepath.Join(bin, "ffmpeg"), FFprobePath: filepath.Join(bin, "ffprobe")}
+	return vod.NewProcessor(config, store, encoder), store
+}
+
+func TestCMAFAudio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-cmaf-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Video.Outputs = []string{vod.OutputCMAF}
+	config.Dedup.Enabled = false
+	config.Presets.Videos = nil
+	config.Presets.Thumbnails = nil
+
+	// The encoder records its arguments before writing its output
+	args := filepath.Join(dir, "args")
+	encoder := filepath.Join(dir, "bin", "ffmpeg")
+	err = ioutil.WriteFile(encoder, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"+strings.TrimPrefix(fakeEncoder, "#!/bin/sh\n")), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The probe of a silent video has no audio stream
+	silent := filepath.Join(dir, "bin", "ffprobe-silent")
+	audio := fakeFFprobe[strings.Index(fakeFFprobe, "    },\n    {\n      \"index\": 1"):strings.Index(fakeFFprobe, "  ],")]
+	err = ioutil.WriteFile(silent, []byte(strings.Replace(fakeFFprobe, audio, "    }\n", 1)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	for _, test := range []struct {
+		probe string
+		audio bool
+	}{
+		{filepath.Join(dir, "bin", "ffprobe"), true},
+		{silent, false},
+	} {
+		processor.Encoder = vod.CommandEncoder{FFmpegPath: encoder, FFprobePath: test.probe}
+		err = store.Put(ctx, config.AWS.InputBucketName, "media/abc/upload.mp4", strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = processor.HandleAWSMedia(ctx, events.S3Entity{Object: events.S3Object{Key: "media/abc/upload.mp4"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded, err := ioutil.ReadFile(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, arg := range []string{"-map 0:a:0", "-c:a aac", "id=1,streams=a"} {
+			if strings.Contains(string(recorded), arg) != test.audio {
+				t.Errorf("Expected %q in the arguments to be %v with audio %v: %s", arg, test.audio, test.audio, recorded)
+			}
+		}
+	}
+}
+
+func TestProcessCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-process-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Privacy.StripMetadata = false
+	config.Dedup.Enabled = false
+	config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "jpg"}}
+
+	// HEIF is only recognised by its signature, so it is stored with the content type of its copy
+	input := filepath.Join(dir, "photo.heic")
+	err = ioutil.WriteFile(input, []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"+strings.Repeat("\x00", 600)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processMain(processor, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := store.List(context.Background(), config.AWS.OutputBucketName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root string
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, "catalogue/") || strings.Count(object.Key, "/") != 2 {
+			t.Fatalf("Expected outputs under a catalogue ID, got %s", object.Key)
+		}
+		root = path.Dir(object.Key)
+	}
+	reader, err := store.Get(context.Background(), config.AWS.OutputBucketName, root+"/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	manifest := new(vod.Manifest)
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Outputs) != 1 || manifest.Outputs[0].Key != root+"/original.heif" || manifest.Outputs[0].ContentType != "image/heif" {
+		t.Errorf("Expected the copy to keep the type of the image, got %+v", manifest.Outputs)
+	}
+}
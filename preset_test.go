@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+func TestPresetConfiguration(t *testing.T) {
+	raw := `{
+		"presets": {
+			"videos": [
+				{ "name": "720p", "width": 1280, "height": 720, "container": "mp4", "quality": 23 },
+				{ "name": "480p", "width": 854, "height": 480, "container": "mp4", "enabled": false }
+			],
+			"thumbnails": []
+		}
+	}`
+	var config vod.Configuration
+	err := json.Unmarshal([]byte(raw), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Presets.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Presets.Images != nil {
+		t.Errorf("Expected missing images to fall back to the default presets")
+	}
+	if config.Presets.Thumbnails == nil || len(config.Presets.Thumbnails) != 0 {
+		t.Errorf("Expected an empty list to disable thumbnails")
+	}
+	videos := config.Presets.Videos
+	if len(videos) != 2 || !videos[0].IsEnabled() || videos[1].IsEnabled() {
+		t.Errorf("Unexpected video presets %+v", videos)
+	}
+
+	invalid := vod.Presets{Images: []vod.Preset{{Name: "bmp", Container: "bmp"}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected unsupported container to be rejected")
+	}
+	invalid = vod.Presets{Thumbnails: []vod.Preset{{Name: "thumb", Codec: vod.PresetCopy}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected thumbnails which copy the video to be rejected")
+	}
+	invalid = vod.Presets{Images: []vod.Preset{{Name: "720", Container: "jpg", Formats: []string{"mp4"}}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected formats which are not images to be rejected")
+	}
+	invalid = vod.Presets{Images: []vod.Preset{{Name: "720", Container: "jpg", Formats: []string{"webp"}, Filename: "720.jpg"}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected formats sharing a filename to be rejected")
+	}
+	invalid = vod.Presets{Images: []vod.Preset{{Name: "200", Container: "jpg", Background: "sky"}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected unknown backgrounds to be rejected")
+	}
+	invalid = vod.Presets{Images: []vod.Preset{{Name: "200", Container: "jpg", Fit: vod.ResizeFill, Focus: "1.5,0"}}}
+	if invalid.Validate() == nil {
+		t.Errorf("Expected focal points outside the image to be rejected")
+	}
+	if vod.DefaultPresets.Validate() != nil {
+		t.Errorf("Expected default presets to be valid")
+	}
+}
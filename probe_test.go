@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+// fakeFFprobe prints the JSON ffprobe writes for a rotated phone recording
+const fakeFFprobe = `#!/bin/sh
+cat > /dev/null
+cat <<'JSON'
+{
+  "streams": [
+    {
+      "index": 0, "codec_name": "h264", "codec_type": "video", "profile": "High",
+      "width": 1920, "height": 1080, "pix_fmt": "yuv420p", "avg_frame_rate": "30000/1001",
+      "color_range": "tv", "color_space": "bt709", "color_transfer": "bt709", "color_primaries": "bt709",
+      "bit_rate": "8000000", "duration": "12.500000",
+      "tags": {"language": "und"},
+      "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]
+    },
+    {
+      "index": 1, "codec_name": "aac", "codec_type": "audio",
+      "sample_rate": "48000", "channels": 2, "channel_layout": "stereo", "bit_rate": "128000",
+      "tags": {"language": "eng"}
+    }
+  ],
+  "format": {
+    "format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "12.512000", "size": "12582912", "bit_rate": "8045000",
+    "tags": {"creation_time": "2020-08-01T10:00:00.000000Z"}
+  }
+}
+JSON
+`
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-probe-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "ffprobe"), []byte(fakeFFprobe), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	info, err := vod.Probe(context.Background(), strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format.Duration != 12.512 || info.Format.Size != 12582912 || info.Format.Tags["creation_time"] == "" {
+		t.Errorf("Unexpected format %+v", info.Format)
+	}
+	if len(info.Video) != 1 || len(info.Audio) != 1 || len(info.Subtitles) != 0 {
+		t.Fatalf("Unexpected streams %+v", info)
+	}
+	video := info.Video[0]
+	if video.Width != 1920 || video.Height != 1080 || video.Rotation != 90 || video.ColorSpace != "bt709" {
+		t.Errorf("Unexpected video stream %+v", video)
+	}
+	if video.FrameRate < 29.97 || video.FrameRate > 29.98 {
+		t.Errorf("Unexpected frame rate %v", video.FrameRate)
+	}
+	audio := info.Audio[0]
+	if audio.Codec != "aac" || audio.SampleRate != 48000 || audio.Channels != 2 || audio.Language != "eng" {
+		t.Errorf("Unexpected audio stream %+v", audio)
+	}
+}
+
+func TestProbeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-probe-failure-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	config.Dedup.Enabled = false
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: filepath.Join(dir, "bin", "ffmpeg"), FFprobePath: "/bin/false"}
+
+	// The server and lambda both reject videos which cannot be probed
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	input, err := ioutil.TempFile(dir, "upload-*.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	input.WriteString(video)
+	err = processor.ProcessVideoFile(ctx, input, "video/mp4", "media/abc")
+	if code := vod.ErrorCode(err); code != "encoder_failed" {
+		t.Errorf("Expected the server to fail with the probe error, got %s: %v", code, err)
+	}
+
+	err = store.Put(ctx, config.AWS.InputBucketName, "media/def/upload.mp4", strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.HandleAWSMedia(ctx, events.S3Entity{Object: events.S3Object{Key: "media/def/upload.mp4"}})
+	if code := vod.ErrorCode(err); code != "encoder_failed" {
+		t.Errorf("Expected lambda to fail with the probe error, got %s: %v", code, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+// fakeFFmpeg writes a script which ignores its arguments, copies stdin to stdout and reports progress like ffmpeg
+const fakeFFmpeg = `#!/bin/sh
+cat
+printf 'frame=120\nout_time_us=5000000\nspeed=2.5x\nprogress=continue\n' >&2
+printf 'frame=240\nout_time_us=10000000\nspeed=2.5x\nprogress=end\n' >&2
+`
+
+func TestVideoResizeProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-progress-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "ffmpeg")
+	err = ioutil.WriteFile(script, []byte(fakeFFmpeg), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updates []vod.Progress
+	var out bytes.Buffer
+	err = vod.VideoResizeCommand(context.Background(), exec.Command(script), strings.NewReader("video"), &out, 20, func(p vod.Progress) {
+		updates = append(updates, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "video" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 progress updates, got %d", len(updates))
+	}
+	first := updates[0]
+	if first.Frame != 120 || first.Time != 5 || first.Speed != 2.5 || first.Percent != 25 || first.Done {
+		t.Errorf("Unexpected progress %+v", first)
+	}
+	if !updates[1].Done || updates[1].Percent != 100 {
+		t.Errorf("Expected final progress to be complete, got %+v", updates[1])
+	}
+}
+
+func TestVideoResizeCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-progress-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The child process keeps stdout open, so the command only returns once the whole process group is killed
+	script := filepath.Join(dir, "ffmpeg")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 30\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	var out bytes.Buffer
+	err = vod.VideoResizeCommand(ctx, exec.Command(script), strings.NewReader(""), &out, 0, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to stop the command, got %v", err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("Command was not stopped at the deadline")
+	}
+}
+
+func TestVideoResizeLongOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-progress-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A line longer than any which is parsed is followed by more output than the pipe holds
+	script := filepath.Join(dir, "ffmpeg")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nhead -c 4000000 /dev/zero | tr '\\0' a >&2\nprintf '\\nframe=1\\rprogress=end\\n' >&2\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	err = vod.VideoResizeCommand(ctx, exec.Command(script), strings.NewReader(""), &out, 0, func(vod.Progress) {})
+	if err != nil {
+		t.Errorf("Expected the whole output to be read, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+func TestPlanRenditions(t *testing.T) {
+	probe := func(width, height, rotation int) *vod.MediaInfo {
+		return &vod.MediaInfo{Video: []vod.StreamInfo{{Width: width, Height: height, Rotation: rotation}}}
+	}
+	cases := []struct {
+		name     string
+		info     *vod.MediaInfo
+		expected []vod.Rendition
+	}{
+		{"landscape", probe(1920, 1080, 0), []vod.Rendition{
+			{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5000},
+			{Name: "720p", Width: 1280, Height: 720, Bitrate: 2800},
+			{Name: "480p", Width: 852, Height: 480, Bitrate: 1400},
+			{Name: "360p", Width: 640, Height: 360, Bitrate: 800},
+			{Name: "240p", Width: 426, Height: 240, Bitrate: 400},
+		}},
+		{"portrait", probe(720, 1280, 0), []vod.Rendition{
+			{Name: "720p", Width: 720, Height: 1280, Bitrate: 2800},
+			{Name: "480p", Width: 480, Height: 852, Bitrate: 1400},
+			{Name: "360p", Width: 360, Height: 640, Bitrate: 800},
+			{Name: "240p", Width: 240, Height: 426, Bitrate: 400},
+		}},
+		{"rotated", probe(1280, 720, 90), []vod.Rendition{
+			{Name: "720p", Width: 720, Height: 1280, Bitrate: 2800},
+			{Name: "480p", Width: 480, Height: 852, Bitrate: 1400},
+			{Name: "360p", Width: 360, Height: 640, Bitrate: 800},
+			{Name: "240p", Width: 240, Height: 426, Bitrate: 400},
+		}},
+		{"small", probe(320, 181, 0), []vod.Rendition{
+			{Name: "180p", Width: 320, Height: 180, Bitrate: 400},
+		}},
+	}
+
+	for _, c := range cases {
+		renditions, err := vod.PlanRenditions(c.info)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(renditions) != len(c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, renditions)
+			continue
+		}
+		for i := range renditions {
+			if renditions[i] != c.expected[i] {
+				t.Errorf("%s: expected %+v, got %+v", c.name, c.expected[i], renditions[i])
+			}
+		}
+	}
+
+	_, err := vod.PlanRenditions(&vod.MediaInfo{})
+	if err == nil {
+		t.Errorf("Expected an error for media without video")
+	}
+}
@@ -0,0 +1,93 @@
+package vod
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// OutputCMAF produces fragmented MP4 segments described by both a DASH manifest and an HLS master playlist
+	OutputCMAF = "cmaf"
+)
+
+// generateCMAF transcodes the input into every rendition as CMAF segments.
+// A single set of segments is referenced by manifest.mpd for DASH players and master.m3u8 for HLS players,
+// and everything is uploaded under destinationRoot/cmaf. audio tells if the input has an audio stream to package.
+func (p *Processor) generateCMAF(ctx context.Context, job *Job, manifest *manifestWriter, input *os.File, renditions []Rendition, audio bool, destinationRoot string, duration float64) error {
+	outputDir, err := ioutil.TempDir("", "cmaf-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	job.setState(JobTranscoding)
+	job.setProgress("cmaf", 0)
+	err = p.startCMAFProcess(ctx, input, outputDir, renditions, audio, duration, job.progressFunc("cmaf"))
+	if err != nil {
+		log.Println("File processing failed for CMAF!")
+		return err
+	}
+	job.setProgress("cmaf", 100)
+
+	job.setState(JobUploading)
+	return p.uploadDirectory(ctx, job, outputDir, destinationRoot+"/cmaf", manifest, func(rel string) *ManifestEntry {
+		return streamEntry(OutputCMAF, rel, renditions, duration)
+	})
+}
+
+func (p *Processor) startCMAFProcess(ctx context.Context, input *os.File, outputDir string, renditions []Rendition, audio bool, duration float64, onProgress ProgressFunc) error {
+	segment := strconv.Itoa(p.segmentDuration())
+	args := []string{"-i", input.Name()}
+	for range renditions {
+		args = append(args, "-map", "0:v:0")
+	}
+	// The audio adaptation set is only declared for inputs which have audio, as ffmpeg rejects empty sets
+	adaptationSets := "id=0,streams=v"
+	if audio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	for i, rendition := range renditions {
+		bitrate := rendition.Bitrate
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), rendition.scaleFilter(),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", bitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", bitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", bitrate*3/2),
+		)
+	}
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-force_key_frames", "expr:gte(t,n_forced*"+segment+")", "-sc_threshold", "0",
+	)
+	if audio {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audioBitrate), "-ac", "2")
+	}
+	args = append(args,
+		"-f", "dash",
+		"-dash_segment_type", "mp4",
+		// Segments are fragmented MP4 branded for CMAF
+		"-format_options", "movflags=cmaf",
+		"-seg_duration", segment,
+		"-use_template", "1", "-use_timeline", "1",
+		"-hls_playlist", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outputDir, "manifest.mpd"),
+	)
+
+	cmd := p.Encoder.Command(ctx, "ffmpeg", args...)
+	err := runCommand(ctx, cmd, duration, onProgress)
+	if err != nil {
+		log.Printf("Failed to start CMAF process")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package vod
+
+import (
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CropFocus sets the part of an image which is kept in frame when it is cropped to fill a box.
+// It is FocusCenter, FocusEntropy, FocusAttention or a focal point written as "x,y" fractions of the width and
+// height of the image, such as "0.5,0.25" for the middle of the upper half, see NewFocalPoint.
+type CropFocus string
+
+const (
+	// FocusCenter crops images evenly around their center
+	FocusCenter CropFocus = "center"
+	// FocusEntropy keeps the part of images with the most detail
+	FocusEntropy CropFocus = "entropy"
+	// FocusAttention keeps the part of images which draws the eye, looking for skin, saturated colors and edges
+	FocusAttention CropFocus = "attention"
+
+	// BackgroundBlur pads images with a blurred copy of themselves covering the box
+	BackgroundBlur = "blur"
+
+	// analysisSize is the longest edge of the copy of an image which is searched for its focus
+	analysisSize = 128
+	// blurScale is how many times the blurred background is shrunk before it is enlarged to the box
+	blurScale = 24
+)
+
+var (
+	errInvalidBackground = errors.New("Background is not a color")
+)
+
+// NewFocalPoint returns the focus keeping the point at x and y, as fractions of the width and height, in frame
+func NewFocalPoint(x, y float64) CropFocus {
+	return CropFocus(strconv.FormatFloat(x, 'f', -1, 64) + "," + strconv.FormatFloat(y, 'f', -1, 64))
+}
+
+func (f CropFocus) valid() bool {
+	switch f {
+	case "", FocusCenter, FocusEntropy, FocusAttention:
+		return true
+	}
+	_, _, ok := f.point()
+	return ok
+}
+
+// point returns the focal point as fractions of the width and height of the image, if the focus is one
+func (f CropFocus) point() (x, y float64, ok bool) {
+	parts := strings.Split(string(f), ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errX != nil || errY != nil || !(x >= 0 && x <= 1) || !(y >= 0 && y <= 1) {
+		return 0, 0, false
+	}
+	return x, y, true
+}
+
+// parseBackground returns the color padding images, black by default, or whether they are padded with a blurred
+// copy. Colors are named black, white or transparent, or written as hexadecimal RGB or RGBA such as "#ffffff".
+func parseBackground(background string) (color.NRGBA, bool, error) {
+	value := strings.TrimPrefix(strings.ToLower(background), "#")
+	switch value {
+	case "", "black":
+		return color.NRGBA{A: 255}, false, nil
+	case "white":
+		return color.NRGBA{R: 255, G: 255, B: 255, A: 255}, false, nil
+	case "transparent":
+		return color.NRGBA{}, false, nil
+	case BackgroundBlur:
+		return color.NRGBA{}, true, nil
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != 4 {
+		return color.NRGBA{}, false, errInvalidBackground
+	}
+	return color.NRGBA{R: decoded[0], G: decoded[1], B: decoded[2], A: decoded[3]}, false, nil
+}
+
+func validBackground(background string) bool {
+	_, _, err := parseBackground(background)
+	return err == nil
+}
+
+// cropOffset returns where the box is cropped from the scaled image, which covers it, to keep the focus in frame
+func cropOffset(scaled *image.RGBA, box image.Point, focus CropFocus) image.Point {
+	size := scaled.Bounds().Size()
+	overflow := size.Sub(box)
+	if x, y, ok := focus.point(); ok {
+		return image.Pt(
+			clampInt(int(math.Round(x*float64(size.X)))-box.X/2, 0, overflow.X),
+			clampInt(int(math.Round(y*float64(size.Y)))-box.Y/2, 0, overflow.Y),
+		)
+	}
+	center := image.Pt(overflow.X/2, overflow.Y/2)
+	if (focus != FocusEntropy && focus != FocusAttention) || overflow == (image.Point{}) {
+		return center
+	}
+
+	// Windows the size of the box are compared on a small copy of the image, starting from the center so that
+	// images without a clear subject stay centered
+	scale := math.Min(1, analysisSize/math.Max(float64(size.X), float64(size.Y)))
+	small := resample(scaled, image.Pt(scaledEdge(size.X, scale), scaledEdge(size.Y, scale)))
+	smallSize := small.Bounds().Size()
+	window := image.Pt(clampInt(scaledEdge(box.X, scale), 1, smallSize.X), clampInt(scaledEdge(box.Y, scale), 1, smallSize.Y))
+	score := attentionScore(small)
+	if focus == FocusEntropy {
+		score = entropyScore(small)
+	}
+
+	smallOverflow := smallSize.Sub(window)
+	best := image.Pt(smallOverflow.X/2, smallOverflow.Y/2)
+	bestScore := score(image.Rectangle{Min: best, Max: best.Add(window)})
+	for y := 0; y <= smallOverflow.Y; y++ {
+		for x := 0; x <= smallOverflow.X; x++ {
+			candidate := image.Pt(x, y)
+			value := score(image.Rectangle{Min: candidate, Max: candidate.Add(window)})
+			if value > bestScore+1e-9 {
+				best, bestScore = candidate, value
+			}
+		}
+	}
+	if best == image.Pt(smallOverflow.X/2, smallOverflow.Y/2) {
+		return center
+	}
+	return image.Pt(
+		clampInt(int(math.Round(float64(best.X)/scale)), 0, overflow.X),
+		clampInt(int(math.Round(float64(best.Y)/scale)), 0, overflow.Y),
+	)
+}
+
+// entropyScore returns the entropy of the luminance of the pixels within a window of the image
+func entropyScore(img *image.RGBA) func(window image.Rectangle) float64 {
+	const bins = 32
+	size := img.Bounds().Size()
+	levels := make([]uint8, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			pixel := img.Pix[y*img.Stride+x*4:]
+			levels[y*size.X+x] = uint8(luminance(pixel) * (bins - 1))
+		}
+	}
+	return func(window image.Rectangle) float64 {
+		var histogram [bins]int
+		for y := window.Min.Y; y < window.Max.Y; y++ {
+			for _, level := range levels[y*size.X+window.Min.X : y*size.X+window.Max.X] {
+				histogram[level]++
+			}
+		}
+		total := float64(window.Dx() * window.Dy())
+		var entropy float64
+		for _, count := range histogram {
+			if count > 0 {
+				p := float64(count) / total
+				entropy -= p * math.Log2(p)
+			}
+		}
+		return entropy
+	}
+}
+
+// attentionScore returns the saliency of the pixels within a window of the image.
+// Skin weighs the most as people are usually the subject, followed by edges and saturated colors.
+func attentionScore(img *image.RGBA) func(window image.Rectangle) float64 {
+	size := img.Bounds().Size()
+	// sums holds the saliency of every pixel above and left of each position, so that windows are summed at once
+	sums := make([]float64, (size.X+1)*(size.Y+1))
+	for y := 0; y < size.Y; y++ {
+		var row float64
+		for x := 0; x < size.X; x++ {
+			pixel := img.Pix[y*img.Stride+x*4:]
+			lum := luminance(pixel)
+			var edge float64
+			if x+1 < size.X {
+				edge += math.Abs(lum - luminance(pixel[4:]))
+			}
+			if y+1 < size.Y {
+				edge += math.Abs(lum - luminance(img.Pix[(y+1)*img.Stride+x*4:]))
+			}
+			row += edge + saturation(pixel) + 3*skin(pixel)
+			sums[(y+1)*(size.X+1)+x+1] = sums[y*(size.X+1)+x+1] + row
+		}
+	}
+	return func(window image.Rectangle) float64 {
+		at := func(x, y int) float64 { return sums[y*(size.X+1)+x] }
+		return at(window.Max.X, window.Max.Y) - at(window.Min.X, window.Max.Y) - at(window.Max.X, window.Min.Y) + at(window.Min.X, window.Min.Y)
+	}
+}
+
+// luminance returns the luma of the RGBA pixel from 0 to 1
+func luminance(pixel []uint8) float64 {
+	return (0.299*float64(pixel[0]) + 0.587*float64(pixel[1]) + 0.114*float64(pixel[2])) / 255
+}
+
+// saturation returns the saturation of the RGBA pixel from 0 to 1
+func saturation(pixel []uint8) float64 {
+	high := math.Max(float64(pixel[0]), math.Max(float64(pixel[1]), float64(pixel[2])))
+	low := math.Min(float64(pixel[0]), math.Min(float64(pixel[1]), float64(pixel[2])))
+	if high == 0 {
+		return 0
+	}
+	return (high - low) / high
+}
+
+// skin returns 1 when the RGBA pixel has a skin tone and 0 otherwise, with the rule of Kovač et al.
+func skin(pixel []uint8) float64 {
+	r, g, b := int(pixel[0]), int(pixel[1]), int(pixel[2])
+	high, low := r, r
+	for _, c := range []int{g, b} {
+		if c > high {
+			high = c
+		}
+		if c < low {
+			low = c
+		}
+	}
+	if r > 95 && g > 40 && b > 20 && high-low > 15 && r-g > 15 && r > b {
+		return 1
+	}
+	return 0
+}
+
+// blurredBackground returns a blurred copy of the image which covers the box, made by shrinking and enlarging it
+func blurredBackground(src image.Image, box image.Point) *image.RGBA {
+	scaled, _ := resizeGeometry(src.Bounds().Size(), box, ResizeFill)
+	shrunk := resample(src, image.Pt(scaledEdge(scaled.X, 1.0/blurScale), scaledEdge(scaled.Y, 1.0/blurScale)))
+	blurred := resample(shrunk, scaled)
+	result := image.NewRGBA(image.Rectangle{Max: box})
+	draw.Draw(result, result.Bounds(), blurred, image.Pt((scaled.X-box.X)/2, (scaled.Y-box.Y)/2), draw.Src)
+	return result
+}
+
+// cropFilter returns the ffmpeg filter which crops the box of the preset around its focal point.
+// Images are cropped around their center when the focus has to be searched for, which only Go does.
+func (p Preset) cropFilter() string {
+	x, y, ok := p.Focus.point()
+	if !ok {
+		return "crop=" + strconv.Itoa(p.Width) + ":" + strconv.Itoa(p.Height)
+	}
+	return "crop=" + strconv.Itoa(p.Width) + ":" + strconv.Itoa(p.Height) +
+		":'clip(iw*" + strconv.FormatFloat(x, 'f', -1, 64) + "-ow/2,0,iw-ow)'" +
+		":'clip(ih*" + strconv.FormatFloat(y, 'f', -1, 64) + "-oh/2,0,ih-oh)'"
+}
+
+func clampInt(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
@@ -0,0 +1,203 @@
+package vod
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// dedupMedia and dedupCatalogue separate the index of videos from the index of catalogue images,
+	// which produce different outputs for the same content
+	dedupMedia     = "media"
+	dedupCatalogue = "catalogue"
+
+	defaultDedupPrefix = "dedup"
+)
+
+// dedupEntry records where the outputs of an upload were written.
+// Outputs holds the video output formats produced, and is empty for images.
+type dedupEntry struct {
+	Checksum  string    `json:"checksum"`
+	Root      string    `json:"root"`
+	Outputs   []string  `json:"outputs,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// newChecksum returns the hash used to identify uploads
+func newChecksum() hash.Hash {
+	return sha256.New()
+}
+
+func checksumString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dataChecksum returns the checksum of an upload held in memory
+func dataChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileChecksum returns the checksum of the file, reading it from the beginning
+func fileChecksum(file *os.File) (string, error) {
+	h := newChecksum()
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return checksumString(h), nil
+}
+
+func (p *Processor) dedupEnabled(checksum string) bool {
+	return p.Config.Dedup.Enabled && checksum != ""
+}
+
+// dedupPrefix returns the location of the index in the output bucket
+func (p *Processor) dedupPrefix() string {
+	if p.Config.Dedup.Prefix == "" {
+		return defaultDedupPrefix
+	}
+	return p.Config.Dedup.Prefix
+}
+
+// dedupKey returns the location of the index entry in the output bucket
+func (p *Processor) dedupKey(kind, checksum string) string {
+	return p.dedupPrefix() + "/" + kind + "/" + checksum + ".json"
+}
+
+// findDuplicate returns the entry of an earlier upload with the same checksum which produced every output requested,
+// or nil when there is none
+func (p *Processor) findDuplicate(ctx context.Context, kind, checksum string, outputs []string) (*dedupEntry, error) {
+	data, err := p.Store.Get(ctx, p.Config.AWS.OutputBucketName, p.dedupKey(kind, checksum))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	entry := new(dedupEntry)
+	err = json.NewDecoder(data).Decode(entry)
+	if err != nil {
+		log.Printf("Ignoring invalid index entry for %s: %s", checksum, err.Error())
+		return nil, nil
+	}
+	for _, output := range outputs {
+		if !hasVideoOutput(entry.Outputs, output) {
+			return nil, nil
+		}
+	}
+	return entry, nil
+}
+
+// reuseOutputs copies the outputs of an earlier upload with the same checksum to destinationRoot.
+// It returns false when the upload has to be processed, because deduplication is disabled, the content is new
+// or the earlier outputs were removed.
+func (p *Processor) reuseOutputs(ctx context.Context, job *Job, kind, checksum, destinationRoot string, outputs []string) (bool, error) {
+	if !p.dedupEnabled(checksum) {
+		return false, nil
+	}
+	entry, err := p.findDuplicate(ctx, kind, checksum, outputs)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	if entry.Root == destinationRoot {
+		// The same upload was processed before, such as when lambda delivers an event again
+		job.setDuplicate(entry.Root)
+		return true, nil
+	}
+
+	bucket := p.Config.AWS.OutputBucketName
+	objects, err := p.Store.List(ctx, bucket, entry.Root+"/")
+	if err != nil {
+		return false, err
+	}
+	if len(objects) == 0 {
+		return false, nil
+	}
+	// Outputs of presets keep the visibility of their preset, which the manifest names
+	presets := map[string]string{}
+	manifest, err := p.readManifest(ctx, entry.Root)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+	if manifest != nil {
+		for _, output := range manifest.Outputs {
+			presets[output.Key] = output.Preset
+		}
+	}
+	for _, object := range objects {
+		if object.Key == entry.Root+"/"+manifestName {
+			continue
+		}
+		key := destinationRoot + strings.TrimPrefix(object.Key, entry.Root)
+		opts := p.outputOptions(object.ContentType)
+		opts.ACL = p.acl(p.presetVisibility(kind, presets[object.Key]))
+		err = p.Store.Copy(ctx, bucket, object.Key, bucket, key, opts)
+		if err != nil {
+			return false, err
+		}
+		job.addOutput(key)
+	}
+	// The manifest lists the keys of the outputs, which differ for the copies
+	err = p.rebaseManifest(ctx, entry.Root, destinationRoot)
+	if err != nil {
+		return false, err
+	}
+	job.setDuplicate(entry.Root)
+	log.Printf("Reused outputs of %s for duplicate upload(%s)", entry.Root, checksum)
+	return true, nil
+}
+
+// presetVisibility returns the visibility of the preset of the kind with the name, which is private when any
+// preset of that name is, or an empty visibility when no preset has the name
+func (p *Processor) presetVisibility(kind, name string) string {
+	presets := p.imagePresets()
+	if kind == dedupMedia {
+		presets = append(p.videoPresets(), p.thumbnailPresets()...)
+	}
+	visibility := ""
+	for _, preset := range presets {
+		if name == "" || preset.Name != name {
+			continue
+		}
+		if p.acl(preset.Visibility) == ACLPrivate {
+			return VisibilityPrivate
+		}
+		visibility = preset.Visibility
+	}
+	return visibility
+}
+
+// recordUpload adds the outputs written under destinationRoot to the index, so later uploads of the same content reuse them
+func (p *Processor) recordUpload(ctx context.Context, kind, checksum, destinationRoot string, outputs []string) error {
+	if !p.dedupEnabled(checksum) {
+		return nil
+	}
+	data, err := json.Marshal(&dedupEntry{
+		Checksum:  checksum,
+		Root:      destinationRoot,
+		Outputs:   outputs,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	// The index is only read by the service
+	return p.completeRequest(ctx, bytes.NewReader(data), PutOptions{ContentType: "application/json", ACL: ACLPrivate}, p.dedupKey(kind, checksum))
+}
@@ -0,0 +1,208 @@
+package vod
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultURLExpiration = time.Hour
+)
+
+var (
+	// negotiatedFormats lists the image containers served in place of an image output when the client accepts them,
+	// smallest first
+	negotiatedFormats = []string{"avif", "webp"}
+)
+
+// DeliveryClient may request signed URLs for the outputs under its Prefixes, such as "catalogue/", by sending
+// its Token as a bearer token
+type DeliveryClient struct {
+	Token    string   `json:"token"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// Validate checks that the client is identified by a token and can read outputs
+func (c DeliveryClient) Validate() error {
+	if c.Token == "" {
+		return errors.New("Delivery client must have a token")
+	}
+	if len(c.Prefixes) == 0 {
+		return errors.New("Delivery client must have key prefixes")
+	}
+	return nil
+}
+
+// LoadCloudFrontKey reads the private key which signs CloudFront URLs, when a CloudFront domain is configured.
+// LoadConfig loads it, so that a missing key stops the application on startup.
+func (c *Configuration) LoadCloudFrontKey() error {
+	cloudfront := &c.Delivery.CloudFront
+	if cloudfront.Domain == "" {
+		return nil
+	}
+	privateKey, err := sign.LoadPEMPrivKeyFile(cloudfront.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot load the CloudFront private key(%s): %v", cloudfront.PrivateKeyPath, err)
+	}
+	cloudfront.privateKey = privateKey
+	return nil
+}
+
+// authorizeDelivery checks that the bearer token in the Authorization header belongs to a client which may read key
+func (p *Processor) authorizeDelivery(authorization, key string) error {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == "" || token == authorization {
+		return newError(ErrForbidden, errors.New("Bearer token is missing"))
+	}
+	for _, client := range p.Config.Delivery.Clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(client.Token)) != 1 {
+			continue
+		}
+		for _, prefix := range client.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return nil
+			}
+		}
+		return newError(ErrForbidden, errors.New("Key is not readable by the client"))
+	}
+	return newError(ErrForbidden, errors.New("Bearer token is invalid"))
+}
+
+// SignedURL is a time-limited URL which reads the output at Key
+type SignedURL struct {
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SignURL returns a URL which reads the output at key until it expires.
+// The URL is signed for CloudFront with the configured key pair when a CloudFront domain is configured,
+// and presigned by the storage backend otherwise.
+func (p *Processor) SignURL(ctx context.Context, key string) (*SignedURL, error) {
+	if !validOutputKey(key) {
+		return nil, newError(ErrInvalidRequest, errors.New("Key is invalid"))
+	}
+	// The deduplication index is not an output
+	if strings.HasPrefix(key, p.dedupPrefix()+"/") {
+		return nil, ErrObjectNotFound
+	}
+	_, err := p.Store.Stat(ctx, p.Config.AWS.OutputBucketName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := time.Duration(p.Config.Delivery.URLExpiration) * time.Second
+	if expiration <= 0 {
+		expiration = defaultURLExpiration
+	}
+	expiresAt := time.Now().UTC().Add(expiration)
+
+	cloudfront := p.Config.Delivery.CloudFront
+	if cloudfront.Domain != "" {
+		if cloudfront.privateKey == nil {
+			return nil, errors.New("CloudFront private key is not loaded")
+		}
+		target := (&url.URL{Scheme: "https", Host: cloudfront.Domain, Path: "/" + key}).String()
+		signed, err := sign.NewURLSigner(cloudfront.KeyPairID, cloudfront.privateKey).Sign(target, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		return &SignedURL{Key: key, URL: signed, ExpiresAt: expiresAt}, nil
+	}
+
+	signer, ok := p.Store.(URLSigner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	signed, err := signer.PresignGet(ctx, p.Config.AWS.OutputBucketName, key, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedURL{Key: key, URL: signed, ExpiresAt: expiresAt}, nil
+}
+
+// NegotiateImage returns the key of the smallest format of the image output at key which the client accepts.
+// accept lists content types as in an Accept header, and only types named explicitly are served in place of the
+// output, as clients accepting */* may not decode newer formats. Key is returned when no other format is stored.
+func (p *Processor) NegotiateImage(ctx context.Context, key, accept string) string {
+	ext := path.Ext(key)
+	if !validOutputKey(key) || !isImageContainer(strings.TrimPrefix(ext, ".")) {
+		return key
+	}
+	for _, name := range negotiatedFormats {
+		if !acceptsType(accept, containers[name].contentType) {
+			continue
+		}
+		candidate := strings.TrimSuffix(key, ext) + "." + name
+		if candidate == key {
+			return key
+		}
+		_, err := p.Store.Stat(ctx, p.Config.AWS.OutputBucketName, candidate)
+		if err == nil {
+			return candidate
+		}
+	}
+	return key
+}
+
+// validOutputKey checks that the key stays within the output bucket
+func validOutputKey(key string) bool {
+	return key != "" && !strings.Contains(key, "..") && !strings.HasPrefix(key, "/")
+}
+
+// acceptsType checks if the Accept header names the content type with a nonzero quality
+func acceptsType(accept, contentType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), contentType) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") && strings.Trim(strings.TrimPrefix(param, "q="), "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// CreateDeliveryServer issues signed URLs for private outputs to the configured delivery clients.
+// Image outputs are negotiated against the accept query parameter, or the Accept header when it is missing.
+func (p *Processor) CreateDeliveryServer(r *gin.Engine) *gin.RouterGroup {
+	g := r.Group("/findapp")
+
+	g.GET("/urls", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		accept := c.Query("accept")
+		if accept == "" {
+			accept = c.GetHeader("Accept")
+		}
+		c.Header("Vary", "Accept")
+		key := c.Query("key")
+		err := p.authorizeDelivery(c.GetHeader("Authorization"), key)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		signed, err := p.SignURL(ctx, p.NegotiateImage(ctx, key, accept))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, signed)
+	})
+
+	return g
+}
@@ -0,0 +1,172 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrNotMedia is returned when the input is not an image or video that can be processed
+	ErrNotMedia = errors.New("Input is not a supported image or video")
+	// ErrUnsupportedCodec is returned when the input uses a codec which cannot be decoded
+	ErrUnsupportedCodec = errors.New("Input uses an unsupported codec")
+	// ErrInvalidResolution is returned when the input is too small to be processed
+	ErrInvalidResolution = errors.New("Input file has invalid resolution")
+	// ErrTooLarge is returned when the input is larger than the maximum upload size
+	ErrTooLarge = errors.New("Input is larger than the maximum upload size")
+	// ErrInvalidRequest is returned when the request is missing or has invalid parameters
+	ErrInvalidRequest = errors.New("Request is invalid")
+	// ErrStorageUnavailable is returned when the storage backend cannot be reached
+	ErrStorageUnavailable = errors.New("Storage is unavailable")
+	// ErrEncoderFailed is returned when ffmpeg or ffprobe fails
+	ErrEncoderFailed = errors.New("Encoder failed to process the input")
+	// ErrTimedOut is returned when processing runs past its deadline
+	ErrTimedOut = errors.New("Processing timed out")
+	// ErrNotSupported is returned when the storage backend does not support an operation
+	ErrNotSupported = errors.New("Operation is not supported by the storage backend")
+	// ErrUploadNotFound is returned when a resumable upload does not exist or expired
+	ErrUploadNotFound = errors.New("Upload does not exist")
+	// ErrOffsetMismatch is returned when data is sent for a resumable upload at an offset other than the size received
+	ErrOffsetMismatch = errors.New("Upload offset does not match the data received")
+	// ErrForbidden is returned when a request is neither signed nor allowed by the configuration
+	ErrForbidden = errors.New("Request is not allowed")
+
+	errNoVideoStream = newError(ErrNotMedia, errors.New("Input file has no video stream"))
+)
+
+// Error describes a failure with the kind of error it is, one of the errors above, and its cause.
+// errors.Is matches both the kind and the cause.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause of the error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// newError returns an error of the kind caused by err
+func newError(kind error, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// errorKind describes how an error is reported
+type errorKind struct {
+	err       error
+	code      string
+	status    int
+	transient bool
+}
+
+// errorKinds lists the reported errors, checked in order
+var errorKinds = []errorKind{
+	{ErrNotMedia, "not_media", http.StatusUnsupportedMediaType, false},
+	{ErrUnsupportedCodec, "unsupported_codec", http.StatusUnprocessableEntity, false},
+	{ErrInvalidResolution, "invalid_resolution", http.StatusUnprocessableEntity, false},
+	{ErrTooLarge, "too_large", http.StatusRequestEntityTooLarge, false},
+	{ErrInvalidRequest, "invalid_request", http.StatusBadRequest, false},
+	{ErrForbidden, "forbidden", http.StatusForbidden, false},
+	{ErrObjectNotFound, "not_found", http.StatusNotFound, false},
+	{ErrJobNotFound, "not_found", http.StatusNotFound, false},
+	{ErrUploadNotFound, "not_found", http.StatusNotFound, false},
+	{ErrOffsetMismatch, "offset_mismatch", http.StatusConflict, false},
+	{ErrQueueFull, "queue_full", http.StatusServiceUnavailable, true},
+	{ErrStorageUnavailable, "storage_unavailable", http.StatusServiceUnavailable, true},
+	{ErrTimedOut, "timed_out", http.StatusGatewayTimeout, true},
+	{context.DeadlineExceeded, "timed_out", http.StatusGatewayTimeout, true},
+	{context.Canceled, "cancelled", http.StatusServiceUnavailable, false},
+	{ErrEncoderFailed, "encoder_failed", http.StatusInternalServerError, false},
+	{ErrNotSupported, "not_supported", http.StatusNotImplemented, false},
+}
+
+// internalError reports errors which are not one of the kinds above
+var internalError = errorKind{errors.New("Cannot proceed with processing due to internal error"), "internal", http.StatusInternalServerError, false}
+
+func kindOf(err error) errorKind {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind
+		}
+	}
+	return internalError
+}
+
+// ErrorCode returns the code used in API responses for the error
+func ErrorCode(err error) string {
+	return kindOf(err).code
+}
+
+// ErrorStatus returns the HTTP status of the error
+func ErrorStatus(err error) int {
+	return kindOf(err).status
+}
+
+// IsTransient reports whether the error may not happen again, so that the work is worth retrying.
+// Lambda handlers only return transient errors, which makes Lambda retry the event.
+func IsTransient(err error) bool {
+	return kindOf(err).transient
+}
+
+// respondError writes the error as a JSON body with its code and status.
+// Client errors describe their cause, while server errors only describe their kind.
+func respondError(c *gin.Context, err error) {
+	kind := kindOf(err)
+	message := kind.err.Error()
+	if kind.status < http.StatusInternalServerError {
+		message = err.Error()
+	}
+	c.JSON(kind.status, gin.H{"error": message, "code": kind.code})
+}
+
+// limitedBody is a request body bounded by http.MaxBytesReader, which fails with ErrTooLarge beyond the limit
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// MaxBytesReader fails once every byte up to the limit was read and more remain
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		return n, newError(ErrTooLarge, fmt.Errorf("Request body is larger than %d bytes", b.limit))
+	}
+	return n, err
+}
+
+// limitBody bounds the body of the request to the maximum upload size, if one is configured
+func (p *Processor) limitBody(c *gin.Context) io.ReadCloser {
+	if p.Config.MaxUploadSize <= 0 {
+		return c.Request.Body
+	}
+	return &limitedBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, p.Config.MaxUploadSize), limit: p.Config.MaxUploadSize}
+}
+
+// readError classifies an error from reading a request body.
+// Errors which already have a kind, such as ErrTooLarge from limitBody, are kept.
+func readError(err error) error {
+	var typed *Error
+	if errors.As(err, &typed) {
+		return err
+	}
+	return newError(ErrInvalidRequest, err)
+}
@@ -1,7 +1,6 @@
 package vod
 
 import (
-	"errors"
 	"net/http"
 	"strings"
 
@@ -9,33 +8,32 @@ import (
 )
 
 // Dimension describes the length and height of image or video.
+// Images are resized into it as its mode describes, padding them by default, see Fit, Background and Focus.
 type Dimension struct {
-	width  int
-	height int
+	width      int
+	height     int
+	mode       ResizeMode
+	background string
+	focus      CropFocus
 }
 
-const (
-	// STOP stops iteration
-	STOP = iota
-)
-
 var (
 	// VideoSizes stores common output sizes for videos which will be used to differentiate quality.
 	// The sizes assume the video aspect ratio is 9:16.
-	// Input streams will be adjusted to match close to these values.
+	// Outputs are described by presets and renditions are planned from the source instead, see Preset and PlanRenditions.
 	//
 	// Source for formats is: https://support.google.com/youtube/answer/6375112?co=GENIE.Platform%3DDesktop&hl=en
 	VideoSizes map[string]Dimension = map[string]Dimension{
-		"2160p": {2160, 3840},
-		"1440p": {1440, 2560},
-		"1080p": {1080, 1920},
-		"720p":  {720, 1280},
-		"480p":  {480, 854},
-		"360p":  {360, 640},
-		"240p":  {240, 426},
+		"2160p": {width: 2160, height: 3840},
+		"1440p": {width: 1440, height: 2560},
+		"1080p": {width: 1080, height: 1920},
+		"720p":  {width: 720, height: 1280},
+		"480p":  {width: 480, height: 854},
+		"360p":  {width: 360, height: 640},
+		"240p":  {width: 240, height: 426},
 	}
 
-	// VideoArray is an ordered list of display sizes supported
+	// VideoArray is an ordered list of display sizes supported, measured on the short edge of the video
 	VideoArray = []int{
 		2160,
 		1440,
@@ -49,30 +47,25 @@ var (
 
 // NewDimension returns a pointer to a Dimension instance
 func NewDimension(w, h int) *Dimension {
-	return &Dimension{w, h}
+	return &Dimension{width: w, height: h}
 }
 
-// FindNearestNext returns the index for which to get the next video resolution
-func (d Dimension) FindNearestNext(cur int) (int, error) {
-	if cur == 0 {
-		// Check if the dimension is larger than maximum
-		if d.height >= VideoArray[0] {
-			return 2, nil
-		} else if d.height >= VideoArray[1] {
-			return 3, nil
-		} else if d.height >= VideoArray[2] {
-			return 3, nil
-		} else if d.height >= VideoArray[3] {
-			return 4, nil
-		} else {
-			return 6, nil
-		}
-	}
-	nextVal := cur + 2
-	if nextVal >= 5 {
-		return STOP, errors.New("No more size available")
-	}
-	return nextVal, nil
+// Fit returns the dimension resizing images with the mode
+func (d Dimension) Fit(mode ResizeMode) Dimension {
+	d.mode = mode
+	return d
+}
+
+// Background returns the dimension padding images with the background, a color such as "#ffffff" or BackgroundBlur
+func (d Dimension) Background(background string) Dimension {
+	d.background = background
+	return d
+}
+
+// Focus returns the dimension keeping the focus in frame when images are cropped to fill it
+func (d Dimension) Focus(focus CropFocus) Dimension {
+	d.focus = focus
+	return d
 }
 
 // IsVideo checks if the provided file header is a video
@@ -100,6 +93,16 @@ func getCatalogueFilePath(input string) string {
 	return "catalogue/" + pathArray[1]
 }
 
+// MediaRoot returns where the outputs of the video with the media ID are written, as for uploads to the input bucket
+func (p *Processor) MediaRoot(id string) string {
+	return getMediaFilePath(p.Config.AWS.MediaPrefixName + id + "/" + uploadFilename)
+}
+
+// CatalogueRoot returns where the outputs of the image with the catalogue ID are written, as for uploads to the input bucket
+func (p *Processor) CatalogueRoot(id string) string {
+	return getCatalogueFilePath(p.Config.AWS.CataloguePrefixName + id + "/" + uploadFilename)
+}
+
 func generatePath(prefix string) string {
 	return prefix + uuid.New().String()
 }
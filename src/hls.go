@@ -0,0 +1,211 @@
+package vod
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// OutputMP4 produces progressive MP4 files
+	OutputMP4 = "mp4"
+	// OutputHLS produces an HLS rendition ladder with a master playlist
+	OutputHLS = "hls"
+
+	// defaultSegmentDuration is the target segment length in seconds when none is configured
+	defaultSegmentDuration = 6
+	// audioBitrate is the AAC bitrate in kbps used for every rendition
+	audioBitrate = 128
+)
+
+var (
+	// VideoBitrates stores the target video bitrate in kbps for each output size.
+	// Values follow the recommendations for SDR uploads at standard frame rates.
+	VideoBitrates = map[string]int{
+		"2160p": 14000,
+		"1440p": 9000,
+		"1080p": 5000,
+		"720p":  2800,
+		"480p":  1400,
+		"360p":  800,
+		"240p":  400,
+	}
+
+	// streamContentTypes maps packaged stream files to their content type
+	streamContentTypes = map[string]string{
+		".m3u8": "application/vnd.apple.mpegurl",
+		".ts":   "video/mp2t",
+		".mpd":  "application/dash+xml",
+		".m4s":  "video/iso.segment",
+	}
+)
+
+// ParseVideoOutputs parses a comma separated list of output formats.
+// An empty list selects the outputs in the configuration.
+func (p *Processor) ParseVideoOutputs(raw string) ([]string, error) {
+	var outputs []string
+	for _, output := range strings.Split(raw, ",") {
+		output = strings.ToLower(strings.TrimSpace(output))
+		switch output {
+		case "":
+			continue
+		case OutputMP4, OutputHLS, OutputCMAF:
+			outputs = append(outputs, output)
+		default:
+			return nil, newError(ErrInvalidRequest, fmt.Errorf("Unsupported output format(%s)", output))
+		}
+	}
+	if len(outputs) == 0 {
+		return p.videoOutputs(), nil
+	}
+	return outputs, nil
+}
+
+// videoOutputs returns the output formats requested in the configuration.
+// Progressive MP4 is produced when nothing is configured.
+func (p *Processor) videoOutputs() []string {
+	if len(p.Config.Video.Outputs) == 0 {
+		return []string{OutputMP4}
+	}
+	return p.Config.Video.Outputs
+}
+
+// hasVideoOutput checks if the output format is among the requested outputs
+func hasVideoOutput(outputs []string, format string) bool {
+	for _, output := range outputs {
+		if strings.EqualFold(output, format) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Processor) segmentDuration() int {
+	if p.Config.Video.SegmentDuration <= 0 {
+		return defaultSegmentDuration
+	}
+	return p.Config.Video.SegmentDuration
+}
+
+// generateHLS transcodes the input into every rendition, segments each rendition
+// and uploads the variant playlists, segments and master playlist under destinationRoot/hls.
+func (p *Processor) generateHLS(ctx context.Context, job *Job, manifest *manifestWriter, input *os.File, renditions []Rendition, destinationRoot string, duration float64) error {
+	outputDir, err := ioutil.TempDir("", "hls-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	job.setState(JobTranscoding)
+	for _, rendition := range renditions {
+		job.setProgress("hls/"+rendition.Name, 0)
+	}
+	for _, rendition := range renditions {
+		name := rendition.Name
+		err = os.Mkdir(filepath.Join(outputDir, name), 0755)
+		if err != nil {
+			return err
+		}
+		err = p.startHLSProcess(ctx, input, filepath.Join(outputDir, name), rendition, duration, job.progressFunc("hls/"+name))
+		if err != nil {
+			log.Printf("File processing failed for %s HLS rendition!", name)
+			return err
+		}
+		job.setProgress("hls/"+name, 100)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(outputDir, "master.m3u8"), []byte(masterPlaylist(renditions)), 0644)
+	if err != nil {
+		return err
+	}
+
+	job.setState(JobUploading)
+	return p.uploadDirectory(ctx, job, outputDir, destinationRoot+"/hls", manifest, func(rel string) *ManifestEntry {
+		return streamEntry(OutputHLS, rel, renditions, duration)
+	})
+}
+
+func (p *Processor) startHLSProcess(ctx context.Context, input *os.File, outputDir string, rendition Rendition, duration float64, onProgress ProgressFunc) error {
+	bitrate := rendition.Bitrate
+	segment := strconv.Itoa(p.segmentDuration())
+	cmd := p.Encoder.Command(ctx, "ffmpeg",
+		"-i", input.Name(),
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", rendition.scaleFilter(),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-b:v", fmt.Sprintf("%dk", bitrate), "-maxrate", fmt.Sprintf("%dk", bitrate*107/100), "-bufsize", fmt.Sprintf("%dk", bitrate*3/2),
+		// Keyframes are forced on segment boundaries so every rendition switches at the same points
+		"-force_key_frames", "expr:gte(t,n_forced*"+segment+")", "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audioBitrate), "-ac", "2",
+		"-f", "hls",
+		"-hls_time", segment,
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, "segment_%03d.ts"),
+		filepath.Join(outputDir, "index.m3u8"),
+	)
+
+	err := runCommand(ctx, cmd, duration, onProgress)
+	if err != nil {
+		log.Printf("Failed to start HLS process")
+		return err
+	}
+
+	return nil
+}
+
+// masterPlaylist returns the master playlist which references the variant playlist of each rendition
+func masterPlaylist(renditions []Rendition) string {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, rendition := range renditions {
+		bandwidth := (rendition.Bitrate + audioBitrate) * 1000
+		fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", bandwidth, rendition.Width, rendition.Height)
+		fmt.Fprintf(&playlist, "%s/index.m3u8\n", rendition.Name)
+	}
+	return playlist.String()
+}
+
+// uploadDirectory uploads every file in the directory to the output bucket, keeping relative paths.
+// Files which describe returns an entry for are recorded in the manifest.
+func (p *Processor) uploadDirectory(ctx context.Context, job *Job, dir string, destination string, manifest *manifestWriter, describe func(rel string) *ManifestEntry) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		contentType, ok := streamContentTypes[filepath.Ext(name)]
+		if !ok {
+			contentType = "application/octet-stream"
+		}
+		key := destination + "/" + filepath.ToSlash(rel)
+		measure := newOutputMeasure()
+		err = p.completeRequest(ctx, io.TeeReader(file, measure), p.outputOptions(contentType), key)
+		if err != nil {
+			return err
+		}
+		job.addOutput(key)
+
+		entry := describe(filepath.ToSlash(rel))
+		if entry == nil {
+			return nil
+		}
+		entry.Key, entry.ContentType = key, contentType
+		entry.Size, entry.Checksum = measure.size, measure.checksum()
+		return manifest.add(ctx, *entry)
+	})
+}
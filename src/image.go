@@ -1,49 +1,60 @@
 package vod
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os/exec"
-	"strconv"
+	"os"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/gin-gonic/gin"
 	"github.com/h2non/filetype"
-
-	"github.com/aws/aws-sdk-go/aws"
 )
 
 // CreateImageServer creates an image server
-func CreateImageServer(r *gin.Engine) *gin.RouterGroup {
+func (p *Processor) CreateImageServer(r *gin.Engine) *gin.RouterGroup {
 	g := r.Group("/findapp")
 
 	g.POST("/catalogue", func(c *gin.Context) {
-		reader := c.Request.Body
-		buf := bufio.NewReaderSize(reader, 600)
-		head, err := buf.Peek(512)
-		contentType := http.DetectContentType(head)
+		// Processing stops if the client disconnects
+		ctx := c.Request.Context()
+		reader := p.limitBody(c)
 		defer reader.Close()
-		if err != nil || (!strings.HasPrefix(contentType, "image") && !filetype.IsVideo(head)) {
-			log.Printf(err.Error())
-			c.JSON(http.StatusNotAcceptable, gin.H{"error": "Cannot proceed with processing due to internal error"})
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			respondError(c, readError(err))
+			return
+		}
+		if len(data) == 0 {
+			respondError(c, ErrNotMedia)
+			return
+		}
+		// Content is detected from at most the first 512 bytes, and small images are shorter
+		head := data
+		if len(head) > 512 {
+			head = head[:512]
+		}
+		contentType := http.DetectContentType(head)
+		if !strings.HasPrefix(contentType, "image") && !filetype.IsVideo(head) {
+			respondError(c, ErrNotMedia)
 			return
 		}
 
-		var out bytes.Buffer
-		err = ResizeImage(buf, &out, *NewDimension(600, 600))
+		err = p.generateImagePresets(ctx, data, "", contentType, generatePath("catalogue/"))
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
 
-		completeRequest(&out, contentType, generatePath("catalogue/")+"/600.png")
 		c.JSON(http.StatusOK, gin.H{"message": "Successfully processed data"})
 	})
 
@@ -51,70 +62,227 @@ func CreateImageServer(r *gin.Engine) *gin.RouterGroup {
 }
 
 // HandleAWSCatalogue is called in lambda upon activity in a lambda
-func HandleAWSCatalogue(s3 events.S3Entity) error {
-	inputData := aws.NewWriteAtBuffer([]byte{})
+func (p *Processor) HandleAWSCatalogue(ctx context.Context, s3 events.S3Entity) error {
+	inputData := new(bytes.Buffer)
 	fileKey, err := url.QueryUnescape(s3.Object.Key)
 	if err != nil {
 		return err
 	}
-	err = downloadData(fileKey, inputData, Config.AWS.InputBucketName)
+	err = p.downloadData(ctx, fileKey, inputData, p.Config.AWS.InputBucketName)
 	if err != nil {
 		return err
 	}
 	imageBytes := inputData.Bytes()
-	bytesReader := bytes.NewReader(imageBytes)
-	contentType := http.DetectContentType(imageBytes[:512])
-	if !strings.HasPrefix(contentType, "image") && !filetype.IsImage(imageBytes[:300]) {
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Cannot proceed with processing due to internal error, %v", err)
-		// If file is not an image, do not return an error to prevent lambda from being rerun.
-		return nil
+	contentType := http.DetectContentType(imageBytes)
+	if !strings.HasPrefix(contentType, "image") && !filetype.IsImage(imageBytes) {
+		return newError(ErrNotMedia, fmt.Errorf("%s is not an image", fileKey))
 	}
 	destinationRoot := getCatalogueFilePath(fileKey)
 
-	// Copy root file to output bucket
-	err = copyData(fileKey, destinationRoot+"/1080.jpg", contentType)
+	return p.generateImagePresets(ctx, imageBytes, fileKey, contentType, destinationRoot)
+}
+
+// ProcessImageInput writes every image preset of the image input under destinationRoot
+func (p *Processor) ProcessImageInput(ctx context.Context, input io.Reader, contentType, destinationRoot string) error {
+	data, err := ioutil.ReadAll(input)
 	if err != nil {
 		return err
 	}
-	var out bytes.Buffer
-	// Save 720 version
-	err = ResizeImage(bytesReader, &out, VideoSizes["720p"])
+	return p.generateImagePresets(ctx, data, "", contentType, destinationRoot)
+}
+
+// generateImagePresets writes every image preset of the image under destinationRoot.
+// key is the location of the upload in the input bucket, used to copy it without uploading it again, and may be empty.
+func (p *Processor) generateImagePresets(ctx context.Context, data []byte, key, contentType, destinationRoot string) error {
+	err := p.checkImagePixels(ctx, data)
 	if err != nil {
 		return err
 	}
-	completeRequest(&out, contentType, destinationRoot+"/720.jpg")
-	// Save 200 version
-	out.Reset()
-	bytesReader.Seek(0, 0)
-	err = ResizeImage(bytesReader, &out, Dimension{200, 200})
+	checksum := dataChecksum(data)
+	reused, err := p.reuseOutputs(ctx, nil, dedupCatalogue, checksum, destinationRoot, nil)
+	if err != nil || reused {
+		return err
+	}
+
+	manifest := p.newManifest(nil, destinationRoot)
+	meta := readImageMetadata(data)
+	manifest.setMetadata(meta)
+	var presets []Preset
+	for _, preset := range p.imagePresets() {
+		presets = append(presets, preset.imageVariants(contentType)...)
+	}
+	for _, preset := range presets {
+		var stripped []byte
+		if preset.Codec == PresetCopy && p.Config.Privacy.StripMetadata {
+			var ok bool
+			stripped, ok = stripMetadata(data)
+			if !ok {
+				// Metadata cannot be removed from this format without encoding it again, as PNG when it cannot be written
+				preset.Codec = ""
+				if _, known := containers[preset.container()]; !known {
+					preset.Container = "png"
+				}
+			}
+		}
+		outputKey := preset.key(destinationRoot)
+		opts := p.presetOptions(preset, contentType)
+		entry := ManifestEntry{Key: outputKey, ContentType: opts.ContentType, Preset: preset.Name}
+		if preset.Codec == PresetCopy && meta != nil {
+			entry.Width, entry.Height = meta.Width, meta.Height
+		}
+		var err error
+		if stripped != nil {
+			err = p.completeRequest(ctx, bytes.NewReader(stripped), opts, outputKey)
+			entry.Size, entry.Checksum = int64(len(stripped)), dataChecksum(stripped)
+		} else if preset.Codec == PresetCopy {
+			if key != "" {
+				err = p.copyData(ctx, key, outputKey, opts)
+			} else {
+				err = p.completeRequest(ctx, bytes.NewReader(data), opts, outputKey)
+			}
+			entry.Size, entry.Checksum = int64(len(data)), checksum
+		} else {
+			measure := newOutputMeasure()
+			err = p.streamRequest(ctx, opts, outputKey, func(ctx context.Context, output io.Writer) error {
+				return p.encodeImage(ctx, bytes.NewReader(data), io.MultiWriter(output, measure), preset)
+			})
+			entry.Width, entry.Height = imageOutputSize(data, preset)
+			entry.Size, entry.Checksum = measure.size, measure.checksum()
+		}
+		if err != nil {
+			log.Printf("File processing failed for %s image!", preset.Name)
+			return err
+		}
+		err = manifest.add(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return p.recordUpload(ctx, dedupCatalogue, checksum, destinationRoot, nil)
+}
+
+// encodeImage resizes and encodes the image with the preset.
+// Images Go can decode are resized natively and ffmpeg only encodes containers other than JPEG and PNG, while
+// other images are resized by ffmpeg, which crops them around their center when their focus has to be searched for.
+// Images are turned upright with their EXIF orientation before they are resized.
+func (p *Processor) encodeImage(ctx context.Context, input io.Reader, output io.Writer, preset Preset) error {
+	data, err := ioutil.ReadAll(input)
 	if err != nil {
 		return err
 	}
-	completeRequest(&out, contentType, destinationRoot+"/200.jpg")
+	// The orientation is applied explicitly, as only some ffmpeg releases read it from images
+	inputArgs := []string{"-noautorotate", "-i", "pipe:0"}
+	if p.Config.Privacy.StripMetadata {
+		inputArgs = append(inputArgs, "-map_metadata", "-1")
+	}
+	filter := orientationFilter(imageOrientation(data))
 
-	return nil
+	err = p.checkImagePixels(ctx, data)
+	if err != nil {
+		return err
+	}
+	resized, err := resizeNative(data, preset)
+	if err == nil {
+		if preset.nativeContainer() {
+			return encodeNative(resized, data, output, preset)
+		}
+		// ffmpeg encodes the resized image losslessly passed as PNG, which needs no further filtering
+		var encoded bytes.Buffer
+		err = encodeNative(resized, data, &encoded, Preset{Container: "png"})
+		if err != nil {
+			return err
+		}
+		data, filter = encoded.Bytes(), ""
+		preset.Width, preset.Height = 0, 0
+	}
+	return p.encodeStill(ctx, inputArgs, filter, bytes.NewReader(data), output, preset, nil)
 }
 
-// ResizeImage resizes the provided image to a destination dimension
-func ResizeImage(input io.Reader, output io.Writer, d Dimension) error {
-	width, height := strconv.Itoa(d.width), strconv.Itoa(d.height)
-	cmd := exec.Command("ffmpeg",
-		"-i", "pipe:0",
-		"-f", "image2",
-		"-vf", fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease,pad=%s:%s:(ow-iw)/2:(oh-ih)/2", width, height, width, height),
-		"pipe:1",
-	)
+// checkImagePixels rejects images with more pixels than the configured maximum before they are decoded.
+// The size of images Go cannot read is probed with ffprobe, and images without a size are rejected.
+func (p *Processor) checkImagePixels(ctx context.Context, data []byte) error {
+	limit := p.Config.MaxImagePixels
+	if limit <= 0 {
+		limit = defaultMaxImagePixels
+	}
+	width, height := 0, 0
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		width, height = config.Width, config.Height
+	} else {
+		info, err := p.Probe(ctx, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if len(info.Video) == 0 || info.Video[0].Width <= 0 || info.Video[0].Height <= 0 {
+			return newError(ErrNotMedia, errors.New("Size of the image cannot be read"))
+		}
+		width, height = info.Video[0].Width, info.Video[0].Height
+	}
+	if int64(width)*int64(height) > limit {
+		return newError(ErrTooLarge, fmt.Errorf("Image of %dx%d pixels is larger than %d pixels", width, height, limit))
+	}
+	return nil
+}
 
-	cmd.Stdin = input
-	cmd.Stdout = output
+// encodeStill encodes a single frame of the input described by inputArgs with the preset, after the filter if any.
+// Containers which cannot be written to a pipe are encoded to a temporary file, which is then copied to output.
+func (p *Processor) encodeStill(ctx context.Context, inputArgs []string, filter string, stdin io.Reader, output io.Writer, preset Preset, onProgress ProgressFunc) error {
+	args := append(append([]string(nil), inputArgs...), "-frames:v", "1")
+	var filters []string
+	for _, f := range []string{filter, preset.scaleFilter()} {
+		if f != "" {
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	args = append(args, preset.encoderArgs()...)
+	if !containers[preset.container()].seekable {
+		cmd := p.Encoder.Command(ctx, "ffmpeg", append(args, "pipe:1")...)
+		cmd.Stdin = stdin
+		cmd.Stdout = output
+		return runCommand(ctx, cmd, 0, onProgress)
+	}
 
-	err := cmd.Run()
+	file, err := ioutil.TempFile("", "still-*."+preset.container())
+	if err != nil {
+		return err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	cmd := p.Encoder.Command(ctx, "ffmpeg", append(args, "-y", file.Name())...)
+	cmd.Stdin = stdin
+	err = runCommand(ctx, cmd, 0, onProgress)
 	if err != nil {
 		return err
 	}
 
+	file, err = os.Open(file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(output, file)
 	return err
 }
+
+// ResizeImage resizes the provided image into the destination dimension with its mode and writes it as PNG.
+// JPEG, PNG and GIF images are resized in Go without running ffmpeg.
+func (p *Processor) ResizeImage(ctx context.Context, input io.Reader, output io.Writer, d Dimension) error {
+	preset := Preset{
+		Name:       "resize",
+		Width:      d.width,
+		Height:     d.height,
+		Fit:        d.mode,
+		Background: d.background,
+		Focus:      d.focus,
+		Container:  "png",
+	}
+	err := preset.Validate()
+	if err != nil {
+		return newError(ErrInvalidRequest, err)
+	}
+	return p.encodeImage(ctx, input, output, preset)
+}
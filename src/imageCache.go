@@ -0,0 +1,189 @@
+package vod
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultImageCacheSize = 1 << 30
+	// imageCacheDir is the directory within the cache path which holds the images, so that other files are left alone
+	imageCacheDir = "transforms"
+	// imageCacheTemp prefixes images which are still being written to the cache
+	imageCacheTemp = "tmp-"
+)
+
+var (
+	// imageCacheKey matches the names of cached images, see transformKey
+	imageCacheKey = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	// imageCacheTempName matches the names of images being written, see ioutil.TempFile
+	imageCacheTempName = regexp.MustCompile(`^` + imageCacheTemp + `[0-9]+$`)
+)
+
+// ImageCache keeps transformed images on the local filesystem, each in a file named after its key in the transforms
+// directory of the cache path. Once the images take more than the size limit, the least recently used ones are
+// removed. Files are touched when they are read, so that the order of use is restored from their modification times
+// after a restart. Only files named like cached images are ever removed.
+type ImageCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// order lists the cached images, most recently used first
+	order *list.List
+}
+
+// imageCacheEntry describes a cached image
+type imageCacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewImageCache returns a cache of the images in dir, which takes at most limit bytes
+func NewImageCache(dir string, limit int64) (*ImageCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, imageCacheDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultImageCacheSize
+	}
+	cache := &ImageCache{dir: dir, limit: limit, entries: map[string]*list.Element{}, order: list.New()}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		// Images which were being written when the server stopped are incomplete
+		if imageCacheTempName.MatchString(file.Name()) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		if imageCacheKey.MatchString(file.Name()) {
+			cache.add(file.Name(), file.Size())
+		}
+	}
+	cache.evict()
+	return cache, nil
+}
+
+// NewImageCache returns the cache of transformed images described by the configuration.
+// Images are cached in the temporary directory when no path is configured.
+func (p *Processor) NewImageCache() (*ImageCache, error) {
+	dir := p.Config.Transform.CachePath
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "vod-images")
+	}
+	return NewImageCache(dir, p.Config.Transform.CacheSize)
+}
+
+func (c *ImageCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// get returns the cached image with the key and marks it as the most recently used
+func (c *ImageCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// The image may have been removed since, in which case it is transformed again and no longer counted
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		c.mu.Lock()
+		// The image is only forgotten when it was not cached again since
+		if c.entries[key] == element {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			c.size -= element.Value.(*imageCacheEntry).size
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	return data, true
+}
+
+// put caches the image with the key, removing the least recently used images when the cache is full.
+// Images larger than the cache are not kept.
+func (c *ImageCache) put(key string, data []byte) error {
+	if !imageCacheKey.MatchString(key) {
+		return fmt.Errorf("Cache key(%s) is invalid", key)
+	}
+	if int64(len(data)) > c.limit {
+		return nil
+	}
+	file, err := ioutil.TempFile(c.dir, imageCacheTemp+"*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, int64(len(data)))
+	c.evict()
+	return nil
+}
+
+// add records the image with the key as the most recently used. It must be called with mu held.
+func (c *ImageCache) add(key string, size int64) {
+	if element, ok := c.entries[key]; ok {
+		c.size -= element.Value.(*imageCacheEntry).size
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&imageCacheEntry{key: key, size: size})
+	c.size += size
+}
+
+// evict removes the least recently used images until the cache fits its limit. It must be called with mu held.
+func (c *ImageCache) evict() {
+	for c.size > c.limit {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*imageCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(c.path(entry.key))
+	}
+}
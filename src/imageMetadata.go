@@ -0,0 +1,569 @@
+package vod
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// exifOrientationTag is the tag of the orientation in the first IFD of EXIF data
+	exifOrientationTag = 0x0112
+	// iccChunkSize is the largest part of an ICC profile which fits in a JPEG APP2 segment
+	iccChunkSize = 65519
+	// maxICCProfileSize bounds the decompressed ICC profile of a PNG image, as a small chunk can inflate to any size.
+	// Profiles are rarely larger than a few hundred kilobytes, and larger ones are skipped.
+	maxICCProfileSize = 4 << 20
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// ImageMetadata holds the details of an uploaded image which are safe to publish.
+// Width and Height are the display size, after Orientation is applied. Location, serial numbers and owner details
+// are never read. ColorProfile is set when the image carries an ICC color profile, which outputs keep.
+type ImageMetadata struct {
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	Orientation  int     `json:"orientation,omitempty"`
+	Make         string  `json:"make,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	LensModel    string  `json:"lensModel,omitempty"`
+	TakenAt      string  `json:"takenAt,omitempty"`
+	ExposureTime string  `json:"exposureTime,omitempty"`
+	FNumber      float64 `json:"fNumber,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focalLength,omitempty"`
+	ColorProfile bool    `json:"colorProfile,omitempty"`
+}
+
+// readImageMetadata returns the safe metadata of the image, or nil when its size cannot be read
+func readImageMetadata(data []byte) *ImageMetadata {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	meta := &ImageMetadata{Width: config.Width, Height: config.Height, Orientation: 1}
+	if exif := findExif(data); exif != nil {
+		readExif(exif, meta)
+	}
+	if meta.Orientation >= 5 && meta.Orientation <= 8 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	meta.ColorProfile = findICC(data) != nil
+	return meta
+}
+
+// imageOrientation returns the EXIF orientation of the image, 1 when it is upright or has none
+func imageOrientation(data []byte) int {
+	meta := &ImageMetadata{Orientation: 1}
+	if exif := findExif(data); exif != nil {
+		readExif(exif, meta)
+	}
+	return meta.Orientation
+}
+
+// jpegSegment is a marker segment of a JPEG file before the image data.
+// data holds the whole segment including its marker and length.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegSegments splits a JPEG file into the segments before the first scan and the rest of the file
+func jpegSegments(data []byte) ([]jpegSegment, []byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, false
+	}
+	var segments []jpegSegment
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return nil, nil, false
+		}
+		marker := data[offset+1]
+		if marker == 0xDA {
+			return segments, data[offset:], true
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return nil, nil, false
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[offset : offset+2+length]})
+		offset += 2 + length
+	}
+	return nil, nil, false
+}
+
+// pngChunk is a chunk of a PNG file, with data holding the whole chunk including its length, type and CRC
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func (c pngChunk) payload() []byte {
+	return c.data[8 : len(c.data)-4]
+}
+
+func pngChunks(data []byte) ([]pngChunk, bool) {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return nil, false
+	}
+	var chunks []pngChunk
+	offset := len(pngHeader)
+	for offset+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if length < 0 || offset+12+length > len(data) {
+			return nil, false
+		}
+		chunk := pngChunk{kind: string(data[offset+4 : offset+8]), data: data[offset : offset+12+length]}
+		chunks = append(chunks, chunk)
+		offset += 12 + length
+		if chunk.kind == "IEND" {
+			return chunks, true
+		}
+	}
+	return nil, false
+}
+
+// pngChunkBytes returns the chunk with its length and CRC
+func pngChunkBytes(kind string, payload []byte) []byte {
+	chunk := make([]byte, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], kind)
+	copy(chunk[8:], payload)
+	binary.BigEndian.PutUint32(chunk[8+len(payload):], crc32.ChecksumIEEE(chunk[4:8+len(payload)]))
+	return chunk
+}
+
+// riffChunk is a chunk of a WebP file, with data holding the whole chunk including its header and padding
+type riffChunk struct {
+	kind string
+	data []byte
+}
+
+func webpChunks(data []byte) ([]riffChunk, bool) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+	var chunks []riffChunk
+	offset := 12
+	for offset+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		end := offset + 8 + length + length%2
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+		chunks = append(chunks, riffChunk{kind: string(data[offset : offset+4]), data: data[offset:end]})
+		offset = end
+	}
+	return chunks, true
+}
+
+// findExif returns the TIFF structure of the EXIF data of a JPEG, PNG or WebP image
+func findExif(data []byte) []byte {
+	if segments, _, ok := jpegSegments(data); ok {
+		for _, segment := range segments {
+			if segment.marker == 0xE1 && bytes.HasPrefix(segment.data[4:], exifHeader) {
+				return segment.data[4+len(exifHeader):]
+			}
+		}
+	}
+	if chunks, ok := pngChunks(data); ok {
+		for _, chunk := range chunks {
+			if chunk.kind == "eXIf" {
+				return chunk.payload()
+			}
+		}
+	}
+	if chunks, ok := webpChunks(data); ok {
+		for _, chunk := range chunks {
+			if chunk.kind == "EXIF" {
+				return bytes.TrimPrefix(chunk.data[8:], exifHeader)
+			}
+		}
+	}
+	return nil
+}
+
+// findICC returns the ICC color profile of a JPEG, PNG or WebP image
+func findICC(data []byte) []byte {
+	if segments, _, ok := jpegSegments(data); ok {
+		// Profiles are split across numbered segments
+		parts := map[int][]byte{}
+		for _, segment := range segments {
+			payload := segment.data[4:]
+			if segment.marker == 0xE2 && bytes.HasPrefix(payload, iccHeader) && len(payload) >= len(iccHeader)+2 {
+				parts[int(payload[len(iccHeader)])] = payload[len(iccHeader)+2:]
+			}
+		}
+		if len(parts) == 0 {
+			return nil
+		}
+		var sequence []int
+		for number := range parts {
+			sequence = append(sequence, number)
+		}
+		sort.Ints(sequence)
+		var profile []byte
+		for _, number := range sequence {
+			profile = append(profile, parts[number]...)
+		}
+		return profile
+	}
+	if chunks, ok := pngChunks(data); ok {
+		for _, chunk := range chunks {
+			if chunk.kind != "iCCP" {
+				continue
+			}
+			// The profile name is followed by the compression method and the compressed profile
+			payload := chunk.payload()
+			name := bytes.IndexByte(payload, 0)
+			if name < 0 || name+2 > len(payload) {
+				return nil
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(payload[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := ioutil.ReadAll(io.LimitReader(reader, maxICCProfileSize+1))
+			if err != nil || len(profile) > maxICCProfileSize {
+				return nil
+			}
+			return profile
+		}
+	}
+	if chunks, ok := webpChunks(data); ok {
+		for _, chunk := range chunks {
+			if chunk.kind == "ICCP" {
+				return chunk.data[8 : 8+binary.LittleEndian.Uint32(chunk.data[4:])]
+			}
+		}
+	}
+	return nil
+}
+
+// tiffReader reads entries of the IFDs of EXIF data with bounds checks
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	tag    uint16
+	kind   uint16
+	count  uint32
+	offset int
+}
+
+// ifd returns the entries of the IFD at offset
+func (r tiffReader) ifd(offset int) []tiffEntry {
+	if offset < 8 || offset+2 > len(r.data) {
+		return nil
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	var entries []tiffEntry
+	for i := 0; i < count; i++ {
+		start := offset + 2 + i*12
+		if start+12 > len(r.data) {
+			break
+		}
+		entry := tiffEntry{
+			tag:    r.order.Uint16(r.data[start:]),
+			kind:   r.order.Uint16(r.data[start+2:]),
+			count:  r.order.Uint32(r.data[start+4:]),
+			offset: start + 8,
+		}
+		// Values larger than four bytes are stored elsewhere
+		if size := tiffTypeSize(entry.kind) * int(entry.count); size > 4 || size < 0 {
+			entry.offset = int(r.order.Uint32(r.data[start+8:]))
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func tiffTypeSize(kind uint16) int {
+	switch kind {
+	case 1, 2, 7:
+		return 1
+	case 3:
+		return 2
+	case 4, 9:
+		return 4
+	case 5, 10:
+		return 8
+	}
+	return 0
+}
+
+func (r tiffReader) value(entry tiffEntry, size int) []byte {
+	if entry.offset < 0 || entry.offset+size > len(r.data) {
+		return nil
+	}
+	return r.data[entry.offset : entry.offset+size]
+}
+
+func (r tiffReader) uint(entry tiffEntry) int {
+	switch entry.kind {
+	case 3:
+		if value := r.value(entry, 2); value != nil {
+			return int(r.order.Uint16(value))
+		}
+	case 4:
+		if value := r.value(entry, 4); value != nil {
+			return int(r.order.Uint32(value))
+		}
+	}
+	return 0
+}
+
+func (r tiffReader) string(entry tiffEntry) string {
+	if entry.kind != 2 || entry.count > 256 {
+		return ""
+	}
+	value := r.value(entry, int(entry.count))
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// rational returns the numerator and denominator of an unsigned rational
+func (r tiffReader) rational(entry tiffEntry) (uint32, uint32) {
+	if entry.kind != 5 {
+		return 0, 0
+	}
+	value := r.value(entry, 8)
+	if value == nil {
+		return 0, 0
+	}
+	return r.order.Uint32(value), r.order.Uint32(value[4:])
+}
+
+func (r tiffReader) float(entry tiffEntry) float64 {
+	numerator, denominator := r.rational(entry)
+	if denominator == 0 {
+		return 0
+	}
+	return math.Round(float64(numerator)/float64(denominator)*100) / 100
+}
+
+// readExif copies the safe fields of the EXIF data into the metadata
+func readExif(data []byte, meta *ImageMetadata) {
+	if len(data) < 8 {
+		return
+	}
+	r := tiffReader{data: data}
+	switch string(data[0:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return
+	}
+
+	exifOffset := 0
+	for _, entry := range r.ifd(int(r.order.Uint32(data[4:]))) {
+		switch entry.tag {
+		case exifOrientationTag:
+			if orientation := r.uint(entry); orientation >= 1 && orientation <= 8 {
+				meta.Orientation = orientation
+			}
+		case 0x010F:
+			meta.Make = r.string(entry)
+		case 0x0110:
+			meta.Model = r.string(entry)
+		case 0x8769:
+			exifOffset = r.uint(entry)
+		}
+	}
+	for _, entry := range r.ifd(exifOffset) {
+		switch entry.tag {
+		case 0x9003:
+			meta.TakenAt = r.string(entry)
+		case 0x829A:
+			if numerator, denominator := r.rational(entry); denominator != 0 {
+				meta.ExposureTime = fmt.Sprintf("%d/%d", numerator, denominator)
+			}
+		case 0x829D:
+			meta.FNumber = r.float(entry)
+		case 0x8827:
+			meta.ISO = r.uint(entry)
+		case 0x920A:
+			meta.FocalLength = r.float(entry)
+		case 0xA434:
+			meta.LensModel = r.string(entry)
+		}
+	}
+}
+
+// orientationExif returns EXIF data which only holds the orientation, so that stripped images still display upright
+func orientationExif(orientation int) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, exifOrientationTag)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	return append(tiff, 0, 0, 0, 0)
+}
+
+// stripMetadata removes EXIF, XMP, IPTC and text metadata from a JPEG, PNG or WebP image, keeping its ICC color
+// profile and its orientation. It returns false for other formats, which cannot be stripped.
+func stripMetadata(data []byte) ([]byte, bool) {
+	orientation := imageOrientation(data)
+	if segments, scan, ok := jpegSegments(data); ok {
+		result := []byte{0xFF, 0xD8}
+		if orientation != 1 {
+			result = append(result, jpegSegmentBytes(0xE1, append(append([]byte(nil), exifHeader...), orientationExif(orientation)...))...)
+		}
+		for _, segment := range segments {
+			// APP0 holds JFIF, APP2 the ICC profile and APP14 the Adobe color transform, other APP segments and
+			// comments hold metadata
+			isApp := segment.marker >= 0xE0 && segment.marker <= 0xEF
+			if (isApp && segment.marker != 0xE0 && segment.marker != 0xE2 && segment.marker != 0xEE) || segment.marker == 0xFE {
+				continue
+			}
+			if segment.marker == 0xE2 && !bytes.HasPrefix(segment.data[4:], iccHeader) {
+				continue
+			}
+			result = append(result, segment.data...)
+		}
+		// Anything after the end of the image, such as the images of an MPF segment, is dropped with the segment
+		return append(result, scan[:jpegScanEnd(scan)]...), true
+	}
+	if chunks, ok := pngChunks(data); ok {
+		result := append([]byte(nil), pngHeader...)
+		for _, chunk := range chunks {
+			switch chunk.kind {
+			case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+				continue
+			}
+			result = append(result, chunk.data...)
+			if chunk.kind == "IHDR" && orientation != 1 {
+				result = append(result, pngChunkBytes("eXIf", orientationExif(orientation))...)
+			}
+		}
+		return result, true
+	}
+	if chunks, ok := webpChunks(data); ok {
+		result := []byte("RIFF\x00\x00\x00\x00WEBP")
+		extended := false
+		for _, chunk := range chunks {
+			switch chunk.kind {
+			case "EXIF", "XMP ":
+				continue
+			case "VP8X":
+				// The extended header flags the metadata the file holds
+				header := append([]byte(nil), chunk.data...)
+				if len(header) > 8 {
+					header[8] &^= 0x0C
+					if orientation != 1 {
+						header[8] |= 0x08
+					}
+					extended = true
+				}
+				result = append(result, header...)
+				continue
+			}
+			result = append(result, chunk.data...)
+		}
+		// Only the extended format holds metadata chunks, and a simple file is decoded without its orientation either
+		if orientation != 1 && extended {
+			exif := orientationExif(orientation)
+			chunk := []byte("EXIF\x00\x00\x00\x00")
+			binary.LittleEndian.PutUint32(chunk[4:], uint32(len(exif)))
+			result = append(result, append(chunk, exif...)...)
+			if len(exif)%2 == 1 {
+				result = append(result, 0)
+			}
+		}
+		binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+		return result, true
+	}
+	return nil, false
+}
+
+// jpegScanEnd returns the length of the scan data up to and including the end of image marker, or of the whole scan
+// data when it has none. A 0xFF byte of entropy coded data is followed by a stuffed zero, so the markers between
+// scans are read by their length until the end of image.
+func jpegScanEnd(scan []byte) int {
+	for i := 0; i+1 < len(scan); i++ {
+		if scan[i] != 0xFF {
+			continue
+		}
+		marker := scan[i+1]
+		switch {
+		case marker == 0xD9:
+			return i + 2
+		case marker == 0x00 || marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Stuffed bytes, fill bytes and restart markers have no length
+			continue
+		}
+		if i+4 > len(scan) {
+			break
+		}
+		i += 1 + int(binary.BigEndian.Uint16(scan[i+2:]))
+	}
+	return len(scan)
+}
+
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// embedICC adds the ICC color profile to a JPEG or PNG image encoded in Go, which writes no profile
+func embedICC(encoded []byte, profile []byte) ([]byte, error) {
+	if len(profile) == 0 {
+		return encoded, nil
+	}
+	if bytes.HasPrefix(encoded, []byte{0xFF, 0xD8}) {
+		count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+		if count > 255 {
+			return encoded, nil
+		}
+		result := []byte{0xFF, 0xD8}
+		for i := 0; i < count; i++ {
+			end := (i + 1) * iccChunkSize
+			if end > len(profile) {
+				end = len(profile)
+			}
+			payload := append(append([]byte(nil), iccHeader...), byte(i+1), byte(count))
+			result = append(result, jpegSegmentBytes(0xE2, append(payload, profile[i*iccChunkSize:end]...))...)
+		}
+		return append(result, encoded[2:]...), nil
+	}
+
+	chunks, ok := pngChunks(encoded)
+	if !ok || len(chunks) == 0 || chunks[0].kind != "IHDR" {
+		return encoded, nil
+	}
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, err := writer.Write(profile)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The profile must come before the image data, right after the header
+	iccp := pngChunkBytes("iCCP", append([]byte("icc\x00\x00"), compressed.Bytes()...))
+	result := append(append([]byte(nil), pngHeader...), chunks[0].data...)
+	result = append(result, iccp...)
+	return append(result, encoded[len(pngHeader)+len(chunks[0].data):]...), nil
+}
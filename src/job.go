@@ -0,0 +1,562 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// JobState describes the stage a job has reached
+type JobState string
+
+const (
+	// JobQueued is the state of a job waiting for a worker
+	JobQueued JobState = "queued"
+	// JobProbing is the state of a job while the input is inspected
+	JobProbing JobState = "probing"
+	// JobTranscoding is the state of a job while outputs are generated
+	JobTranscoding JobState = "transcoding"
+	// JobUploading is the state of a job while outputs are written to storage
+	JobUploading JobState = "uploading"
+	// JobDone is the state of a job which completed successfully
+	JobDone JobState = "done"
+	// JobFailed is the state of a job which could not be completed
+	JobFailed JobState = "failed"
+
+	defaultJobWorkers   = 1
+	defaultJobQueueSize = 32
+	defaultJobRetention = 24 * time.Hour
+)
+
+var (
+	// ErrQueueFull is returned when a job cannot be accepted because too many jobs are waiting
+	ErrQueueFull = errors.New("Too many jobs are waiting to be processed")
+	// ErrJobNotFound is returned when a job does not exist
+	ErrJobNotFound = errors.New("Job does not exist")
+)
+
+// Job describes the processing of a single upload.
+// InputKey identifies where the upload came from, Outputs holds the requested output formats,
+// Written holds the keys of the outputs stored so far and Progress holds the completion percentage of each rendition.
+// Checksum identifies the content of the upload and DuplicateOf holds the root of the outputs reused for it, if any.
+type Job struct {
+	ID          string             `json:"id"`
+	MediaID     string             `json:"mediaId"`
+	InputKey    string             `json:"inputKey,omitempty"`
+	ContentType string             `json:"contentType"`
+	Outputs     []string           `json:"outputs"`
+	State       JobState           `json:"state"`
+	Progress    map[string]float64 `json:"progress"`
+	Written     []string           `json:"written"`
+	Checksum    string             `json:"checksum,omitempty"`
+	DuplicateOf string             `json:"duplicateOf,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	ErrorCode   string             `json:"errorCode,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt"`
+
+	inputPath   string
+	store       *JobStore
+	subscribers map[chan struct{}]bool
+	cancel      context.CancelFunc
+	cancelled   bool
+	mu          sync.RWMutex
+}
+
+// NewVideoJob returns a queued job for the video stored at inputPath.
+// The job owns the input file and removes it once processing ends.
+func NewVideoJob(inputKey, inputPath, contentType string, outputs []string) *Job {
+	now := time.Now().UTC()
+	return &Job{
+		ID:          uuid.New().String(),
+		MediaID:     uuid.New().String(),
+		InputKey:    inputKey,
+		ContentType: contentType,
+		Outputs:     outputs,
+		State:       JobQueued,
+		Progress:    map[string]float64{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		inputPath:   inputPath,
+	}
+}
+
+// Snapshot returns a copy of the job which is safe to read while the job is processed
+func (j *Job) Snapshot() *Job {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	progress := make(map[string]float64, len(j.Progress))
+	for name, value := range j.Progress {
+		progress[name] = value
+	}
+	return &Job{
+		ID:          j.ID,
+		MediaID:     j.MediaID,
+		InputKey:    j.InputKey,
+		ContentType: j.ContentType,
+		Outputs:     append([]string(nil), j.Outputs...),
+		State:       j.State,
+		Progress:    progress,
+		Written:     append([]string(nil), j.Written...),
+		Checksum:    j.Checksum,
+		DuplicateOf: j.DuplicateOf,
+		Error:       j.Error,
+		ErrorCode:   j.ErrorCode,
+		CreatedAt:   j.CreatedAt,
+		UpdatedAt:   j.UpdatedAt,
+	}
+}
+
+// save records the job in the job store, if the job is stored
+func (j *Job) save() {
+	if j.store == nil {
+		return
+	}
+	err := j.store.Save(j)
+	if err != nil {
+		log.Printf("Failed to save job %s: %s", j.ID, err.Error())
+	}
+}
+
+// subscribe returns a channel which is signalled whenever the job changes.
+// The returned function must be called once updates are no longer needed.
+func (j *Job) subscribe() (<-chan struct{}, func()) {
+	updates := make(chan struct{}, 1)
+	j.mu.Lock()
+	if j.subscribers == nil {
+		j.subscribers = map[chan struct{}]bool{}
+	}
+	j.subscribers[updates] = true
+	j.mu.Unlock()
+
+	return updates, func() {
+		j.mu.Lock()
+		delete(j.subscribers, updates)
+		j.mu.Unlock()
+	}
+}
+
+// notify signals subscribers that the job changed.
+// Subscribers which have not consumed the previous signal are not blocked on.
+func (j *Job) notify() {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for updates := range j.subscribers {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// finished checks if the job reached a final state
+func (j *Job) finished() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// expired checks if the job ended longer than retention ago
+func (j *Job) expired(retention time.Duration) bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return (j.State == JobDone || j.State == JobFailed) && time.Since(j.UpdatedAt) > retention
+}
+
+// progressFunc returns a callback which records ffmpeg progress against the rendition
+func (j *Job) progressFunc(rendition string) ProgressFunc {
+	if j == nil {
+		return nil
+	}
+	return func(p Progress) {
+		j.setProgress(rendition, p.Percent)
+	}
+}
+
+// Cancel stops the job.
+// A queued job fails when a worker picks it up and a running job is interrupted, killing its ffmpeg processes.
+func (j *Job) Cancel() {
+	j.mu.Lock()
+	j.cancelled = true
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// start records the function which interrupts the running job.
+// It returns false if the job was cancelled before it started.
+func (j *Job) start(cancel context.CancelFunc) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancel = cancel
+	return !j.cancelled
+}
+
+// destinationRoot returns the location of the job outputs
+func (j *Job) destinationRoot() string {
+	return "media/" + j.MediaID
+}
+
+// setState records the stage reached by the job.
+// Jobs are optional in the pipeline, so calls on a nil job are ignored.
+func (j *Job) setState(state JobState) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.State = state
+	j.UpdatedAt = time.Now().UTC()
+	j.mu.Unlock()
+	j.save()
+	j.notify()
+}
+
+// addOutput records the key of an output written to storage
+func (j *Job) addOutput(key string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.Written = append(j.Written, key)
+	j.UpdatedAt = time.Now().UTC()
+	j.mu.Unlock()
+	j.save()
+	j.notify()
+}
+
+// setDuplicate records the root of the outputs reused for the job
+func (j *Job) setDuplicate(root string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.DuplicateOf = root
+	j.UpdatedAt = time.Now().UTC()
+	j.mu.Unlock()
+	j.save()
+	j.notify()
+}
+
+// setProgress records the completion percentage of a rendition
+func (j *Job) setProgress(rendition string, percent float64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.Progress[rendition] = percent
+	j.UpdatedAt = time.Now().UTC()
+	j.mu.Unlock()
+	j.notify()
+}
+
+// fail marks the job as failed with the cause
+func (j *Job) fail(err error) {
+	j.mu.Lock()
+	j.State = JobFailed
+	j.Error = err.Error()
+	j.ErrorCode = ErrorCode(err)
+	j.UpdatedAt = time.Now().UTC()
+	j.mu.Unlock()
+	j.save()
+	j.notify()
+}
+
+// JobQueue processes jobs in the background with a fixed number of workers.
+// Jobs are recorded in the job store when one is configured and are interrupted once they run longer than timeout.
+// Jobs which ended are forgotten after retention.
+type JobQueue struct {
+	mu        sync.RWMutex
+	jobs      map[string]*Job
+	pending   chan *Job
+	store     *JobStore
+	timeout   time.Duration
+	retention time.Duration
+	processor *Processor
+}
+
+// NewJobQueue creates a job queue which processes uploads with the package storage backend, see Processor.NewJobQueue
+func NewJobQueue(config *Configuration) (*JobQueue, error) {
+	return NewProcessor(config, Store, nil).NewJobQueue()
+}
+
+// NewJobQueue creates a job queue which processes uploads with the processor and starts its workers.
+// Jobs left unfinished by a previous run are resumed when their upload is still staged and marked as failed otherwise.
+func (p *Processor) NewJobQueue() (*JobQueue, error) {
+	config := p.Config
+	workers, size := config.Jobs.Workers, config.Jobs.QueueSize
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	if size <= 0 {
+		size = defaultJobQueueSize
+	}
+
+	retention := time.Duration(config.Jobs.Retention) * time.Second
+	if retention <= 0 {
+		retention = defaultJobRetention
+	}
+
+	q := &JobQueue{
+		jobs:      map[string]*Job{},
+		pending:   make(chan *Job, size),
+		timeout:   time.Duration(config.Jobs.Timeout) * time.Second,
+		retention: retention,
+		processor: p,
+	}
+	if config.Jobs.Path != "" {
+		store, err := NewJobStore(config.Jobs.Path)
+		if err != nil {
+			return nil, err
+		}
+		q.store = store
+	}
+
+	// Workers start first so that resumed jobs are taken off the queue as it fills
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	if q.store != nil {
+		err := q.resume()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// resume loads stored jobs and schedules the unfinished ones again.
+// Resumed jobs wait for room in the queue rather than failing when there are more than it holds.
+func (q *JobQueue) resume() error {
+	jobs, err := q.store.Load()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var resumed []*Job
+	for _, job := range jobs {
+		job.store = q.store
+		if job.expired(q.retention) {
+			q.store.Delete(job.ID)
+			continue
+		}
+		if job.State == JobDone || job.State == JobFailed {
+			q.jobs[job.ID] = job
+			continue
+		}
+
+		_, err = os.Stat(job.inputPath)
+		if err != nil {
+			log.Printf("Job %s cannot be resumed: %s", job.ID, err.Error())
+			job.fail(errors.New("Processing was interrupted by a server restart"))
+			q.processor.notifyJob(WebhookJobFailed, job)
+			q.jobs[job.ID] = job
+			continue
+		}
+
+		// Outputs are written to the same media ID, so the job restarts from the beginning
+		job.mu.Lock()
+		job.Progress = map[string]float64{}
+		job.Written = nil
+		job.DuplicateOf = ""
+		job.mu.Unlock()
+		job.setState(JobQueued)
+		q.jobs[job.ID] = job
+		q.processor.notifyJob(WebhookJobAccepted, job)
+		resumed = append(resumed, job)
+	}
+	go func() {
+		for _, job := range resumed {
+			q.pending <- job
+		}
+	}()
+	return nil
+}
+
+// Enqueue schedules the job for processing.
+// ErrQueueFull is returned if the job cannot be accepted.
+func (q *JobQueue) Enqueue(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	job.store = q.store
+	job.save()
+	select {
+	case q.pending <- job:
+		q.jobs[job.ID] = job
+		q.processor.notifyJob(WebhookJobAccepted, job)
+		return nil
+	default:
+		// The job was saved so that it is resumed once accepted, and a rejected job must not be
+		if q.store != nil {
+			q.store.Delete(job.ID)
+		}
+		return ErrQueueFull
+	}
+}
+
+// prune forgets the jobs which ended longer than the retention ago. It must be called with mu held.
+func (q *JobQueue) prune() {
+	for id, job := range q.jobs {
+		if !job.expired(q.retention) {
+			continue
+		}
+		delete(q.jobs, id)
+		if q.store != nil {
+			q.store.Delete(id)
+		}
+	}
+}
+
+// Get returns the job with the provided ID
+func (q *JobQueue) Get(id string) (*Job, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+func (q *JobQueue) work() {
+	for job := range q.pending {
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if q.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), q.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		var err error
+		if job.start(cancel) {
+			err = q.run(ctx, job)
+		} else {
+			os.Remove(job.inputPath)
+			err = context.Canceled
+		}
+		cancel()
+
+		if err != nil {
+			log.Printf("Job %s failed: %s", job.ID, err.Error())
+			job.fail(err)
+			q.processor.notifyJob(WebhookJobFailed, job)
+			continue
+		}
+		job.setState(JobDone)
+		q.processor.notifyJob(WebhookJobCompleted, job)
+	}
+}
+
+func (q *JobQueue) run(ctx context.Context, job *Job) error {
+	defer os.Remove(job.inputPath)
+
+	input, err := os.Open(job.inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	return q.processor.processVideo(ctx, job, input, job.Checksum, job.ContentType, job.destinationRoot(), job.Outputs)
+}
+
+// newUploadFile creates the file used to stage an upload until its job ends.
+// Uploads are kept beside the job store so that they can be resumed after a restart.
+func (q *JobQueue) newUploadFile() (*os.File, error) {
+	dir := ""
+	if q.store != nil {
+		dir = q.store.UploadDir()
+	}
+	return ioutil.TempFile(dir, "upload-*")
+}
+
+// stageUpload saves the upload to a file which outlives the request and returns the checksum of its content
+func (q *JobQueue) stageUpload(data io.Reader) (*os.File, string, error) {
+	file, err := q.newUploadFile()
+	if err != nil {
+		return nil, "", err
+	}
+	checksum := newChecksum()
+	_, err = io.Copy(io.MultiWriter(file, checksum), data)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", readError(err)
+	}
+	return file, checksumString(checksum), nil
+}
+
+// acceptJob enqueues the job and responds with its location
+func acceptJob(c *gin.Context, queue *JobQueue, job *Job) {
+	err := queue.Enqueue(job)
+	if err != nil {
+		os.Remove(job.inputPath)
+		log.Printf(err.Error())
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Location", "/findapp/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Successfully queued data", "jobId": job.ID, "mediaId": job.MediaID})
+}
+
+// CreateJobServer exposes the status of queued jobs
+func CreateJobServer(r *gin.Engine, queue *JobQueue) *gin.RouterGroup {
+	g := r.Group("/findapp")
+
+	g.GET("/jobs/:id", func(c *gin.Context) {
+		job, ok := queue.Get(c.Param("id"))
+		if !ok {
+			respondError(c, ErrJobNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, job.Snapshot())
+	})
+
+	g.DELETE("/jobs/:id", func(c *gin.Context) {
+		job, ok := queue.Get(c.Param("id"))
+		if !ok {
+			respondError(c, ErrJobNotFound)
+			return
+		}
+		job.Cancel()
+		c.JSON(http.StatusAccepted, gin.H{"message": "Job is being cancelled"})
+	})
+
+	// Stream the job status as Server-Sent Events until the job ends or the client disconnects
+	g.GET("/jobs/:id/events", func(c *gin.Context) {
+		job, ok := queue.Get(c.Param("id"))
+		if !ok {
+			respondError(c, ErrJobNotFound)
+			return
+		}
+		updates, unsubscribe := job.subscribe()
+		defer unsubscribe()
+
+		c.Stream(func(w io.Writer) bool {
+			c.SSEvent("status", job.Snapshot())
+			if job.finished() {
+				return false
+			}
+			select {
+			case <-updates:
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
+	return g
+}
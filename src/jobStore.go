@@ -0,0 +1,120 @@
+package vod
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JobStore records jobs on the local filesystem so they survive restarts.
+// Each job is stored as a JSON file named after its ID, and uploads waiting to be processed are kept in
+// the uploads directory beside them. Records are written one at a time.
+type JobStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// jobRecord is the stored form of a job.
+// It keeps the location of the staged input, which is not exposed by the API.
+type jobRecord struct {
+	*Job
+	InputPath string `json:"inputPath"`
+}
+
+// NewJobStore returns a job store rooted at the provided directory
+func NewJobStore(dir string) (*JobStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(dir, "uploads"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &JobStore{dir: dir}, nil
+}
+
+// UploadDir returns the directory where uploads are staged until their job ends
+func (s *JobStore) UploadDir() string {
+	return filepath.Join(s.dir, "uploads")
+}
+
+// Save writes the current state of the job.
+// The record is replaced atomically so a crash never leaves a partial record.
+func (s *JobStore) Save(job *Job) error {
+	// Saves of the same job are serialized, so that an older state never replaces a newer one
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.mu.RLock()
+	data, err := json.Marshal(jobRecord{Job: job, InputPath: job.inputPath})
+	job.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(s.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filepath.Join(s.dir, job.ID+".json"))
+}
+
+// Delete removes the record of the job
+func (s *JobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Load returns every stored job, oldest first
+func (s *JobStore) Load() ([]*Job, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		record := jobRecord{}
+		err = json.Unmarshal(data, &record)
+		if err != nil || record.Job == nil {
+			// A damaged record must not stop the server from starting
+			log.Printf("Skipping unreadable job record %s", file.Name())
+			continue
+		}
+		record.Job.inputPath = record.InputPath
+		if record.Job.Progress == nil {
+			record.Job.Progress = map[string]float64{}
+		}
+		jobs = append(jobs, record.Job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
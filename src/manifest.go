@@ -0,0 +1,189 @@
+package vod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// manifestName is the name of the manifest under each media and catalogue root
+	manifestName = "manifest.json"
+)
+
+// Manifest lists the outputs written under a media or catalogue root.
+// It is written as manifest.json next to the outputs and replaced as each output completes.
+// Metadata holds the details read from catalogue images which are safe to publish.
+type Manifest struct {
+	Root      string          `json:"root"`
+	Metadata  *ImageMetadata  `json:"metadata,omitempty"`
+	Outputs   []ManifestEntry `json:"outputs"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// ManifestEntry describes a single output.
+// Preset is the name of the preset which produced the output, or the packaging format for HLS and CMAF playlists.
+// Rendition names the rendition of variant playlists. Dimensions are the display size of the output and are
+// omitted when unknown, as for copies of images Go cannot decode. Checksum is the SHA-256 checksum of the output.
+type ManifestEntry struct {
+	Key         string  `json:"key"`
+	ContentType string  `json:"contentType"`
+	Preset      string  `json:"preset,omitempty"`
+	Rendition   string  `json:"rendition,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	Size        int64   `json:"size"`
+	Checksum    string  `json:"checksum"`
+}
+
+// manifestWriter records outputs as they complete and writes the manifest after each one.
+// Each write replaces the whole manifest, so readers never see a partial manifest.
+// Outputs of presets and packaging formats are announced to webhooks once the manifest lists them.
+type manifestWriter struct {
+	p        *Processor
+	job      *Job
+	mu       sync.Mutex
+	manifest Manifest
+}
+
+// newManifest returns the manifest of the outputs under destinationRoot, which job may be nil for
+func (p *Processor) newManifest(job *Job, destinationRoot string) *manifestWriter {
+	return &manifestWriter{p: p, job: job, manifest: Manifest{Root: destinationRoot}}
+}
+
+// setMetadata records the metadata of the input, written with the next output
+func (m *manifestWriter) setMetadata(meta *ImageMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manifest.Metadata = meta
+}
+
+// add records the output, replacing any earlier entry with the same key, and writes the manifest
+func (m *manifestWriter) add(ctx context.Context, entry ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replaced := false
+	for i := range m.manifest.Outputs {
+		if m.manifest.Outputs[i].Key == entry.Key {
+			m.manifest.Outputs[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		m.manifest.Outputs = append(m.manifest.Outputs, entry)
+	}
+	m.manifest.UpdatedAt = time.Now().UTC()
+	err := m.p.writeManifest(ctx, &m.manifest)
+	if err != nil || entry.Preset == "" {
+		return err
+	}
+
+	event := newWebhookEvent(WebhookRenditionCompleted, m.manifest.Root)
+	if m.job != nil {
+		event.JobID, event.InputKey = m.job.ID, m.job.InputKey
+	}
+	event.Output = &entry
+	m.p.Webhooks.Send(event)
+	return nil
+}
+
+func (p *Processor) writeManifest(ctx context.Context, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return p.completeRequest(ctx, bytes.NewReader(data), p.outputOptions("application/json"), manifest.Root+"/"+manifestName)
+}
+
+// readManifest returns the manifest of the outputs under root
+func (p *Processor) readManifest(ctx context.Context, root string) (*Manifest, error) {
+	data, err := p.Store.Get(ctx, p.Config.AWS.OutputBucketName, root+"/"+manifestName)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	manifest := new(Manifest)
+	err = json.NewDecoder(data).Decode(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// rebaseManifest writes the manifest of the outputs under root for their copies under destinationRoot
+func (p *Processor) rebaseManifest(ctx context.Context, root, destinationRoot string) error {
+	manifest, err := p.readManifest(ctx, root)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	manifest.Root = destinationRoot
+	for i := range manifest.Outputs {
+		manifest.Outputs[i].Key = destinationRoot + strings.TrimPrefix(manifest.Outputs[i].Key, root)
+	}
+	manifest.UpdatedAt = time.Now().UTC()
+	return p.writeManifest(ctx, manifest)
+}
+
+// outputMeasure counts and hashes an output while it is written
+type outputMeasure struct {
+	size int64
+	hash hash.Hash
+}
+
+func newOutputMeasure() *outputMeasure {
+	return &outputMeasure{hash: newChecksum()}
+}
+
+func (m *outputMeasure) Write(data []byte) (int, error) {
+	m.size += int64(len(data))
+	return m.hash.Write(data)
+}
+
+func (m *outputMeasure) checksum() string {
+	return checksumString(m.hash)
+}
+
+// displaySize returns the size of the first video stream as it is displayed, taking rotation into account
+func displaySize(info *MediaInfo) (int, int) {
+	if info == nil || len(info.Video) == 0 {
+		return 0, 0
+	}
+	stream := info.Video[0]
+	if normalizeRotation(stream.Rotation)%180 == 90 {
+		return stream.Height, stream.Width
+	}
+	return stream.Width, stream.Height
+}
+
+// streamEntry describes the playlists of HLS and CMAF outputs, which are listed in the manifest without their segments.
+// rel is the location of the file within the output directory of the format.
+func streamEntry(format, rel string, renditions []Rendition, duration float64) *ManifestEntry {
+	ext := path.Ext(rel)
+	if ext != ".m3u8" && ext != ".mpd" {
+		return nil
+	}
+	entry := &ManifestEntry{Preset: format, Duration: duration}
+	name := path.Base(rel)
+	for i, rendition := range renditions {
+		// HLS variants are written to a directory per rendition, while CMAF playlists are numbered by stream
+		if path.Dir(rel) == rendition.Name || name == "media_"+strconv.Itoa(i)+".m3u8" {
+			entry.Rendition = rendition.Name
+			entry.Width = rendition.Width
+			entry.Height = rendition.Height
+		}
+	}
+	return entry
+}
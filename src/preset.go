@@ -0,0 +1,367 @@
+package vod
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/filetype"
+)
+
+const (
+	// PresetCopy is the codec of presets which store the upload without encoding it again
+	PresetCopy = "copy"
+
+	// VisibilityPublic outputs can be read by anyone
+	VisibilityPublic = "public"
+	// VisibilityPrivate outputs can only be read with a signed URL
+	VisibilityPrivate = "private"
+)
+
+// Preset describes a single file produced for every upload.
+// Width and height bound the output, with 0 keeping the size of the source. Images and thumbnails are resized into
+// the box as Fit describes, padding them by default, while videos are fit within it in the orientation of the source.
+// Background is the color padding images, or BackgroundBlur, and Focus is the part of images kept when they fill
+// the box, see CropFocus.
+// Codec defaults to the usual codec of the container. Quality is passed to the encoder, as the CRF for videos
+// and AVIF, the JPEG scale and the WebP quality from 0 to 100, and 0 leaves the encoder default.
+// Copies of images are named after the type of the upload rather than Container.
+// Formats lists further containers each image preset is encoded to, such as "webp" and "avif", with the default
+// quality of their encoder, so that the smallest one a client accepts can be served.
+// Filename is a template for the name of the output under the media or catalogue root, which can reference
+// {name}, {width}, {height} and {ext}, and defaults to {name}.{ext}.
+// Visibility is VisibilityPublic or VisibilityPrivate, and defaults to the visibility of the delivery configuration.
+type Preset struct {
+	Name       string     `json:"name"`
+	Enabled    *bool      `json:"enabled,omitempty"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Fit        ResizeMode `json:"fit,omitempty"`
+	Background string     `json:"background,omitempty"`
+	Focus      CropFocus  `json:"focus,omitempty"`
+	Codec      string     `json:"codec"`
+	Quality    int        `json:"quality"`
+	Container  string     `json:"container"`
+	Formats    []string   `json:"formats,omitempty"`
+	Filename   string     `json:"filename"`
+	Visibility string     `json:"visibility,omitempty"`
+}
+
+// Presets lists the files produced for each kind of upload.
+// A kind which is missing from the configuration uses DefaultPresets, while an empty list produces nothing.
+type Presets struct {
+	Images     []Preset `json:"images"`
+	Videos     []Preset `json:"videos"`
+	Thumbnails []Preset `json:"thumbnails"`
+}
+
+// container describes how ffmpeg writes a container.
+// Containers which are seekable cannot be written to a pipe.
+type container struct {
+	format      string
+	codec       string
+	contentType string
+	seekable    bool
+}
+
+var (
+	disabled = false
+
+	// DefaultPresets are the outputs produced when the configuration does not list any
+	DefaultPresets = Presets{
+		Images: []Preset{
+			{Name: "1080", Codec: PresetCopy, Container: "jpg"},
+			{Name: "720", Width: 720, Height: 1280, Container: "jpg", Formats: []string{"webp", "avif"}},
+			{Name: "600", Width: 600, Height: 600, Fit: ResizeFill, Focus: FocusAttention, Container: "png", Formats: []string{"webp", "avif"}},
+			{Name: "200", Width: 200, Height: 200, Fit: ResizeFill, Focus: FocusAttention, Container: "jpg", Formats: []string{"webp", "avif"}},
+		},
+		Videos: []Preset{
+			{Name: "1080p", Codec: PresetCopy, Container: "mp4", Filename: "1080.mp4"},
+			// The transcode adds to the processing time of every upload, so deployments enable it when they need it
+			{Name: "720p", Width: 1280, Height: 720, Container: "mp4", Quality: 23, Filename: "720.mp4", Enabled: &disabled},
+		},
+		Thumbnails: []Preset{
+			{Name: "thumb", Width: 600, Height: 600, Container: "png"},
+			{Name: "1080", Width: 1080, Height: 1920, Container: "jpg"},
+			{Name: "720", Width: 720, Height: 1280, Container: "jpg"},
+		},
+	}
+
+	// containers lists the containers presets can be written to
+	containers = map[string]container{
+		"mp4":  {format: "mp4", codec: "libx264", contentType: "video/mp4"},
+		"jpg":  {format: "image2pipe", codec: "mjpeg", contentType: "image/jpeg"},
+		"png":  {format: "image2pipe", codec: "png", contentType: "image/png"},
+		"gif":  {format: "gif", codec: "gif", contentType: "image/gif"},
+		"webp": {format: "webp", codec: "libwebp", contentType: "image/webp"},
+		"avif": {format: "avif", codec: "libaom-av1", contentType: "image/avif", seekable: true},
+	}
+
+	// qualityOptions maps encoders to the option which sets their quality
+	qualityOptions = map[string]string{
+		"libx264":    "-crf",
+		"libx265":    "-crf",
+		"mjpeg":      "-q:v",
+		"libwebp":    "-quality",
+		"libaom-av1": "-crf",
+	}
+)
+
+// IsEnabled checks if the preset should be produced. Presets are enabled unless disabled explicitly.
+func (p Preset) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// Validate checks that the preset can be produced
+func (p Preset) Validate() error {
+	if p.Name == "" {
+		return errors.New("Preset must have a name")
+	}
+	if p.Width < 0 || p.Height < 0 {
+		return fmt.Errorf("Preset(%s) has invalid dimension", p.Name)
+	}
+	if _, ok := containers[p.container()]; !ok && p.Codec != PresetCopy {
+		return fmt.Errorf("Preset(%s) has unsupported container(%s)", p.Name, p.Container)
+	}
+	if !validResizeMode(p.Fit) {
+		return fmt.Errorf("Preset(%s) has unknown fit(%s)", p.Name, p.Fit)
+	}
+	if !validBackground(p.Background) {
+		return fmt.Errorf("Preset(%s) has invalid background(%s)", p.Name, p.Background)
+	}
+	if !p.Focus.valid() {
+		return fmt.Errorf("Preset(%s) has invalid focus(%s)", p.Name, p.Focus)
+	}
+	if !validVisibility(p.Visibility) {
+		return fmt.Errorf("Preset(%s) has unknown visibility(%s)", p.Name, p.Visibility)
+	}
+	for _, format := range p.Formats {
+		if !isImageContainer(format) {
+			return fmt.Errorf("Preset(%s) has unsupported image format(%s)", p.Name, format)
+		}
+	}
+	if len(p.Formats) > 0 && p.Filename != "" && !strings.Contains(p.Filename, "{ext}") {
+		return fmt.Errorf("Preset(%s) with several formats must have {ext} in its filename", p.Name)
+	}
+	return nil
+}
+
+func isImageContainer(name string) bool {
+	return strings.HasPrefix(containers[Preset{Container: name}.container()].contentType, "image/")
+}
+
+func validVisibility(visibility string) bool {
+	return visibility == "" || visibility == VisibilityPublic || visibility == VisibilityPrivate
+}
+
+// Validate checks every preset of each kind
+func (p Presets) Validate() error {
+	for _, kind := range [][]Preset{p.Images, p.Videos, p.Thumbnails} {
+		for _, preset := range kind {
+			err := preset.Validate()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, preset := range p.Thumbnails {
+		if preset.Codec == PresetCopy {
+			return fmt.Errorf("Thumbnail preset(%s) cannot copy the video", preset.Name)
+		}
+	}
+	for _, preset := range append(append([]Preset(nil), p.Videos...), p.Thumbnails...) {
+		if len(preset.Formats) > 0 {
+			return fmt.Errorf("Preset(%s) can only list formats for images", preset.Name)
+		}
+	}
+	return nil
+}
+
+func (p Preset) container() string {
+	name := strings.ToLower(p.Container)
+	if name == "jpeg" {
+		return "jpg"
+	}
+	return name
+}
+
+// imageVariants returns the preset and a preset for each of its further formats.
+// Copies take the container of the upload, so that their extension matches their content.
+func (p Preset) imageVariants(inputType string) []Preset {
+	primary := p
+	primary.Formats = nil
+	if p.Codec == PresetCopy {
+		primary.Container = copyContainer(inputType, p.Container)
+	}
+
+	variants := []Preset{primary}
+	for _, name := range p.Formats {
+		name = Preset{Container: name}.container()
+		if name == primary.container() {
+			continue
+		}
+		variant := primary
+		variant.Container, variant.Codec, variant.Quality = name, "", 0
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+// copyContainer returns the container named after the content type of an upload, such as "bmp" for image/bmp.
+// fallback is only used for content types which have no known extension.
+func copyContainer(inputType, fallback string) string {
+	for name, format := range containers {
+		if format.contentType == inputType {
+			return name
+		}
+	}
+	for extension, kind := range filetype.Types {
+		if kind.MIME.Value == inputType {
+			return extension
+		}
+	}
+	return fallback
+}
+
+// key returns the location of the output under destinationRoot
+func (p Preset) key(destinationRoot string) string {
+	filename := p.Filename
+	if filename == "" {
+		filename = "{name}.{ext}"
+	}
+	filename = strings.NewReplacer(
+		"{name}", p.Name,
+		"{width}", strconv.Itoa(p.Width),
+		"{height}", strconv.Itoa(p.Height),
+		"{ext}", p.container(),
+	).Replace(filename)
+	return destinationRoot + "/" + filename
+}
+
+// contentType returns the content type of the output. Copies keep the content type of the input.
+func (p Preset) contentType(inputType string) string {
+	if p.Codec == PresetCopy {
+		return inputType
+	}
+	return containers[p.container()].contentType
+}
+
+// encoderArgs returns the ffmpeg output options which encode to the codec, quality and container of the preset
+func (p Preset) encoderArgs() []string {
+	format := containers[p.container()]
+	codec := p.Codec
+	if codec == "" {
+		codec = format.codec
+	}
+
+	args := []string{"-c:v", codec}
+	if option, ok := qualityOptions[codec]; ok && p.Quality > 0 {
+		args = append(args, option, strconv.Itoa(p.Quality))
+	}
+	if codec == "libaom-av1" && format.format == "avif" {
+		args = append(args, "-still-picture", "1")
+	}
+	if format.format == "mp4" {
+		// Fragmented output can be written to a pipe
+		args = append(args, "-c:a", "aac", "-movflags", "frag_keyframe+empty_moov")
+	}
+	return append(args, "-f", format.format)
+}
+
+// padFilter returns the ffmpeg filter which fits the image in the box of the preset and pads the rest,
+// or an empty filter when the preset keeps the size of the source
+func (p Preset) padFilter() string {
+	if p.Width == 0 || p.Height == 0 {
+		return ""
+	}
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", p.Width, p.Height, p.Width, p.Height)
+}
+
+// videoFilter returns the ffmpeg filter which fits the video in the box of the preset.
+// The box is turned to the orientation of the probed source and the source is never upscaled.
+// Sources which could not be probed are padded to the box as is.
+func (p Preset) videoFilter(info *MediaInfo) string {
+	if p.Width == 0 || p.Height == 0 {
+		return ""
+	}
+	if info == nil || len(info.Video) == 0 {
+		return p.padFilter()
+	}
+	stream := info.Video[0]
+	size, err := fitRendition(Dimension{width: stream.Width, height: stream.Height}, stream.Rotation, Dimension{width: p.Width, height: p.Height})
+	if err != nil {
+		return p.padFilter()
+	}
+	return fmt.Sprintf("scale=%d:%d", size.width, size.height)
+}
+
+// presetOptions returns how the output of the preset is stored
+func (p *Processor) presetOptions(preset Preset, inputType string) PutOptions {
+	return PutOptions{ContentType: preset.contentType(inputType), ACL: p.acl(preset.Visibility)}
+}
+
+// outputOptions returns how outputs which are not described by a preset, such as HLS segments, are stored
+func (p *Processor) outputOptions(contentType string) PutOptions {
+	return PutOptions{ContentType: contentType, ACL: p.acl("")}
+}
+
+// acl returns the ACL of outputs with the visibility, falling back to the configured visibility.
+// Outputs are public unless configured otherwise.
+func (p *Processor) acl(visibility string) string {
+	if visibility == "" {
+		visibility = p.Config.Delivery.Visibility
+	}
+	if visibility == VisibilityPrivate {
+		return ACLPrivate
+	}
+	return ACLPublicRead
+}
+
+// videoSize returns the display size of the video output of the preset for the probed source, as scaled by videoFilter.
+// Zeros are returned when the size of a copy of the source is unknown.
+func (p Preset) videoSize(info *MediaInfo) (int, int) {
+	if p.Width == 0 || p.Height == 0 {
+		return displaySize(info)
+	}
+	if info == nil || len(info.Video) == 0 {
+		return p.Width, p.Height
+	}
+	stream := info.Video[0]
+	size, err := fitRendition(Dimension{width: stream.Width, height: stream.Height}, stream.Rotation, Dimension{width: p.Width, height: p.Height})
+	if err != nil {
+		return p.Width, p.Height
+	}
+	return size.width, size.height
+}
+
+func (p *Processor) imagePresets() []Preset {
+	if p.Config.Presets.Images == nil {
+		return enabledPresets(DefaultPresets.Images)
+	}
+	return enabledPresets(p.Config.Presets.Images)
+}
+
+func (p *Processor) videoPresets() []Preset {
+	if p.Config.Presets.Videos == nil {
+		return enabledPresets(DefaultPresets.Videos)
+	}
+	return enabledPresets(p.Config.Presets.Videos)
+}
+
+func (p *Processor) thumbnailPresets() []Preset {
+	if p.Config.Presets.Thumbnails == nil {
+		return enabledPresets(DefaultPresets.Thumbnails)
+	}
+	return enabledPresets(p.Config.Presets.Thumbnails)
+}
+
+func enabledPresets(presets []Preset) []Preset {
+	var result []Preset
+	for _, preset := range presets {
+		if preset.IsEnabled() {
+			result = append(result, preset)
+		}
+	}
+	return result
+}
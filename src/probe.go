@@ -0,0 +1,322 @@
+package vod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MediaInfo describes the container and streams of a media file
+type MediaInfo struct {
+	Format    FormatInfo   `json:"format"`
+	Video     []StreamInfo `json:"video"`
+	Audio     []StreamInfo `json:"audio"`
+	Subtitles []StreamInfo `json:"subtitles"`
+}
+
+// FormatInfo describes the container of a media file.
+// Duration is in seconds and BitRate in bits per second.
+type FormatInfo struct {
+	Name     string            `json:"name"`
+	LongName string            `json:"longName"`
+	Duration float64           `json:"duration"`
+	Size     int64             `json:"size"`
+	BitRate  int64             `json:"bitRate"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// StreamInfo describes a single stream of a media file.
+// Video fields are empty for audio and subtitle streams and audio fields are empty for other streams.
+// Rotation is the clockwise rotation in degrees needed to display the video upright.
+type StreamInfo struct {
+	Index          int               `json:"index"`
+	Codec          string            `json:"codec"`
+	CodecLongName  string            `json:"codecLongName"`
+	Profile        string            `json:"profile,omitempty"`
+	Duration       float64           `json:"duration"`
+	BitRate        int64             `json:"bitRate"`
+	Language       string            `json:"language,omitempty"`
+	Width          int               `json:"width,omitempty"`
+	Height         int               `json:"height,omitempty"`
+	FrameRate      float64           `json:"frameRate,omitempty"`
+	PixelFormat    string            `json:"pixelFormat,omitempty"`
+	Rotation       int               `json:"rotation"`
+	ColorRange     string            `json:"colorRange,omitempty"`
+	ColorSpace     string            `json:"colorSpace,omitempty"`
+	ColorTransfer  string            `json:"colorTransfer,omitempty"`
+	ColorPrimaries string            `json:"colorPrimaries,omitempty"`
+	SampleRate     int               `json:"sampleRate,omitempty"`
+	Channels       int               `json:"channels,omitempty"`
+	ChannelLayout  string            `json:"channelLayout,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// ffprobeOutput mirrors the JSON written by ffprobe.
+// Numbers are reported as strings for most fields.
+type ffprobeOutput struct {
+	Streams []struct {
+		Index          int               `json:"index"`
+		CodecName      string            `json:"codec_name"`
+		CodecLongName  string            `json:"codec_long_name"`
+		CodecType      string            `json:"codec_type"`
+		Profile        string            `json:"profile"`
+		Width          int               `json:"width"`
+		Height         int               `json:"height"`
+		PixelFormat    string            `json:"pix_fmt"`
+		FrameRate      string            `json:"avg_frame_rate"`
+		RealFrameRate  string            `json:"r_frame_rate"`
+		ColorRange     string            `json:"color_range"`
+		ColorSpace     string            `json:"color_space"`
+		ColorTransfer  string            `json:"color_transfer"`
+		ColorPrimaries string            `json:"color_primaries"`
+		SampleRate     string            `json:"sample_rate"`
+		Channels       int               `json:"channels"`
+		ChannelLayout  string            `json:"channel_layout"`
+		BitRate        string            `json:"bit_rate"`
+		Duration       string            `json:"duration"`
+		Tags           map[string]string `json:"tags"`
+		SideData       []struct {
+			Type     string  `json:"side_data_type"`
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		Name     string            `json:"format_name"`
+		LongName string            `json:"format_long_name"`
+		Duration string            `json:"duration"`
+		Size     string            `json:"size"`
+		BitRate  string            `json:"bit_rate"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// Probe inspects the media with a single ffprobe run and returns its container and stream information.
+// Files are read by name so that ffprobe can seek, other readers are streamed to ffprobe.
+func (p *Processor) Probe(ctx context.Context, input io.Reader) (*MediaInfo, error) {
+	source := "pipe:0"
+	if file, ok := input.(*os.File); ok {
+		source = file.Name()
+	}
+	cmd := p.Encoder.Command(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-i", source,
+	)
+
+	var out bytes.Buffer
+	if source == "pipe:0" {
+		cmd.Stdin = input
+	}
+	cmd.Stdout = &out
+	err := runCommand(ctx, cmd, 0, nil)
+	if err != nil {
+		log.Printf(err.Error())
+		return nil, err
+	}
+
+	var raw ffprobeOutput
+	err = json.Unmarshal(out.Bytes(), &raw)
+	if err != nil {
+		return nil, err
+	}
+	return newMediaInfo(&raw), nil
+}
+
+func newMediaInfo(raw *ffprobeOutput) *MediaInfo {
+	info := &MediaInfo{
+		Format: FormatInfo{
+			Name:     raw.Format.Name,
+			LongName: raw.Format.LongName,
+			Duration: parseFloat(raw.Format.Duration),
+			Size:     parseInt(raw.Format.Size),
+			BitRate:  parseInt(raw.Format.BitRate),
+			Tags:     raw.Format.Tags,
+		},
+	}
+
+	for _, s := range raw.Streams {
+		stream := StreamInfo{
+			Index:         s.Index,
+			Codec:         s.CodecName,
+			CodecLongName: s.CodecLongName,
+			Profile:       s.Profile,
+			Duration:      parseFloat(s.Duration),
+			BitRate:       parseInt(s.BitRate),
+			Language:      s.Tags["language"],
+			Tags:          s.Tags,
+		}
+		switch s.CodecType {
+		case "video":
+			stream.Width, stream.Height = s.Width, s.Height
+			stream.PixelFormat = s.PixelFormat
+			stream.FrameRate = parseRational(s.FrameRate)
+			if stream.FrameRate == 0 {
+				stream.FrameRate = parseRational(s.RealFrameRate)
+			}
+			stream.ColorRange, stream.ColorSpace = s.ColorRange, s.ColorSpace
+			stream.ColorTransfer, stream.ColorPrimaries = s.ColorTransfer, s.ColorPrimaries
+
+			// Older containers carry rotation as a clockwise tag, newer ones as a counter-clockwise display matrix
+			if rotate, ok := s.Tags["rotate"]; ok {
+				stream.Rotation = normalizeRotation(int(parseInt(rotate)))
+			}
+			for _, side := range s.SideData {
+				if side.Type == "Display Matrix" {
+					stream.Rotation = normalizeRotation(-int(side.Rotation))
+				}
+			}
+			info.Video = append(info.Video, stream)
+		case "audio":
+			stream.SampleRate = int(parseInt(s.SampleRate))
+			stream.Channels = s.Channels
+			stream.ChannelLayout = s.ChannelLayout
+			info.Audio = append(info.Audio, stream)
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, stream)
+		}
+	}
+	return info
+}
+
+// Dimension returns the coded size of the first video stream
+func (m *MediaInfo) Dimension() (*Dimension, error) {
+	if len(m.Video) == 0 {
+		return nil, errNoVideoStream
+	}
+	result := Dimension{width: m.Video[0].Width, height: m.Video[0].Height}
+	if result.height <= 10 || result.width <= 10 {
+		return nil, ErrInvalidResolution
+	}
+	return &result, nil
+}
+
+// probeVideo probes the video and checks that it can be processed, returning its duration.
+// Videos which cannot be probed fail with the error of the probe, so that the server and lambda reject the same uploads.
+func (p *Processor) probeVideo(ctx context.Context, input *os.File) (*MediaInfo, float64, error) {
+	info, err := p.Probe(ctx, input)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = info.validateVideo()
+	if err != nil {
+		return nil, 0, err
+	}
+	duration, err := info.Duration()
+	if err != nil {
+		return nil, 0, err
+	}
+	return info, duration, nil
+}
+
+// validateVideo checks that the first video stream can be decoded and has a usable size
+func (m *MediaInfo) validateVideo() error {
+	_, err := m.Dimension()
+	if err != nil {
+		return err
+	}
+	if m.Video[0].Codec == "" {
+		return ErrUnsupportedCodec
+	}
+	return nil
+}
+
+// Duration returns the length of the media in seconds
+func (m *MediaInfo) Duration() (float64, error) {
+	if m.Format.Duration < 0 {
+		return 0, errors.New("Input file has invalid duration")
+	}
+	return m.Format.Duration, nil
+}
+
+// storeMetadata writes the probe result as metadata.json under destinationRoot and records it in the manifest
+func (p *Processor) storeMetadata(ctx context.Context, manifest *manifestWriter, info *MediaInfo, destinationRoot string) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := destinationRoot + "/metadata.json"
+	err = p.completeRequest(ctx, bytes.NewReader(data), p.outputOptions("application/json"), key)
+	if err != nil {
+		return err
+	}
+	return manifest.add(ctx, ManifestEntry{Key: key, ContentType: "application/json", Size: int64(len(data)), Checksum: dataChecksum(data)})
+}
+
+// CreateProbeServer exposes media probing over HTTP
+func (p *Processor) CreateProbeServer(r *gin.Engine) *gin.RouterGroup {
+	g := r.Group("/findapp")
+
+	g.POST("/probe", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		reader := p.limitBody(c)
+		defer reader.Close()
+
+		// Containers may keep their index at the end of the file, so the upload is saved before probing
+		file, err := ioutil.TempFile("", "probe-*")
+		if err != nil {
+			log.Printf(err.Error())
+			respondError(c, err)
+			return
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		_, err = io.Copy(file, reader)
+		if err != nil {
+			log.Printf(err.Error())
+			respondError(c, readError(err))
+			return
+		}
+
+		info, err := p.Probe(ctx, file)
+		if errors.Is(err, ErrEncoderFailed) {
+			// ffprobe fails on anything it cannot read as media
+			err = newError(ErrNotMedia, err)
+		}
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, info)
+	})
+
+	return g
+}
+
+func normalizeRotation(degrees int) int {
+	return ((degrees % 360) + 360) % 360
+}
+
+func parseInt(value string) int64 {
+	result, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return result
+}
+
+func parseFloat(value string) float64 {
+	result, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return result
+}
+
+// parseRational parses ffprobe rationals such as 30000/1001
+func parseRational(value string) float64 {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return parseFloat(value)
+	}
+	denominator := parseFloat(parts[1])
+	if denominator == 0 {
+		return 0
+	}
+	return parseFloat(parts[0]) / denominator
+}
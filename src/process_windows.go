@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package vod
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is not needed on windows, where the process is killed directly
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup stops the command
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+}
@@ -0,0 +1,142 @@
+package vod
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gin-gonic/gin"
+)
+
+// Processor processes images and videos with its own configuration, storage backend and encoder.
+// Several processors can be used within one program, and creating one has no side effects.
+// Webhooks is optional and receives the events of processed uploads.
+type Processor struct {
+	Config   *Configuration
+	Store    Storage
+	Encoder  Encoder
+	Webhooks *Webhooks
+}
+
+// Encoder creates the ffmpeg and ffprobe commands used for processing
+type Encoder interface {
+	// Command returns the command which runs the tool, either "ffmpeg" or "ffprobe", with the arguments.
+	// The command must be stopped when the context is done.
+	Command(ctx context.Context, tool string, args ...string) *exec.Cmd
+}
+
+// CommandEncoder runs ffmpeg and ffprobe from the paths provided, or from PATH when a path is empty
+type CommandEncoder struct {
+	FFmpegPath  string
+	FFprobePath string
+}
+
+// Command returns the command which runs the tool with the arguments
+func (e CommandEncoder) Command(ctx context.Context, tool string, args ...string) *exec.Cmd {
+	path := tool
+	switch {
+	case tool == "ffmpeg" && e.FFmpegPath != "":
+		path = e.FFmpegPath
+	case tool == "ffprobe" && e.FFprobePath != "":
+		path = e.FFprobePath
+	}
+	return exec.CommandContext(ctx, path, args...)
+}
+
+// NewProcessor returns a processor using the configuration, storage backend and encoder.
+// An empty configuration is used when config is nil and ffmpeg is run from PATH when encoder is nil.
+func NewProcessor(config *Configuration, store Storage, encoder Encoder) *Processor {
+	if config == nil {
+		config = &Configuration{}
+	}
+	if encoder == nil {
+		encoder = CommandEncoder{}
+	}
+	return &Processor{Config: config, Store: store, Encoder: encoder}
+}
+
+// NewProcessorFromConfig returns a processor using the storage backend and webhooks selected in the configuration
+func NewProcessorFromConfig(config *Configuration) (*Processor, error) {
+	store, err := NewStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	processor := NewProcessor(config, store, nil)
+	processor.Webhooks = NewWebhooks(config)
+	return processor, nil
+}
+
+// defaultProcessor returns a processor using the package configuration and storage backend set by Initialize.
+// It backs the package level functions which predate Processor.
+func defaultProcessor() *Processor {
+	return NewProcessor(Config, Store, nil)
+}
+
+// Probe inspects the media using the package configuration, see Processor.Probe
+func Probe(ctx context.Context, input io.Reader) (*MediaInfo, error) {
+	return defaultProcessor().Probe(ctx, input)
+}
+
+// GetDimension returns the dimension of video from stream, see Processor.GetDimension
+func GetDimension(ctx context.Context, video io.Reader) (*Dimension, error) {
+	return defaultProcessor().GetDimension(ctx, video)
+}
+
+// GetDuration returns the duration of video from stream, see Processor.GetDuration
+func GetDuration(ctx context.Context, video io.Reader) (float64, error) {
+	return defaultProcessor().GetDuration(ctx, video)
+}
+
+// ProcessVideoInput processes the video input using the package configuration, see Processor.ProcessVideoInput
+func ProcessVideoInput(ctx context.Context, input *os.File, contentType string, outputs ...string) error {
+	return defaultProcessor().ProcessVideoInput(ctx, input, contentType, outputs...)
+}
+
+// ProcessVideoFile processes the video input using the package configuration, see Processor.ProcessVideoFile
+func ProcessVideoFile(ctx context.Context, input *os.File, contentType, destinationRoot string, outputs ...string) error {
+	return defaultProcessor().ProcessVideoFile(ctx, input, contentType, destinationRoot, outputs...)
+}
+
+// ProcessImageInput processes the image input using the package configuration, see Processor.ProcessImageInput
+func ProcessImageInput(ctx context.Context, input io.Reader, contentType, destinationRoot string) error {
+	return defaultProcessor().ProcessImageInput(ctx, input, contentType, destinationRoot)
+}
+
+// ResizeImage resizes the provided image to a destination dimension, see Processor.ResizeImage
+func ResizeImage(ctx context.Context, input io.Reader, output io.Writer, d Dimension) error {
+	return defaultProcessor().ResizeImage(ctx, input, output, d)
+}
+
+// HandleAWSMedia is called in lambda upon activity in a lambda, see Processor.HandleAWSMedia
+func HandleAWSMedia(ctx context.Context, s3 events.S3Entity) error {
+	return defaultProcessor().HandleAWSMedia(ctx, s3)
+}
+
+// HandleAWSMediaOld is called in lambda upon activity in a lambda, see Processor.HandleAWSMediaOld.
+//
+// Deprecated: call HandleAWSMedia instead.
+func HandleAWSMediaOld(ctx context.Context, s3 events.S3Entity) error {
+	return defaultProcessor().HandleAWSMediaOld(ctx, s3)
+}
+
+// HandleAWSCatalogue is called in lambda upon activity in a lambda, see Processor.HandleAWSCatalogue
+func HandleAWSCatalogue(ctx context.Context, s3 events.S3Entity) error {
+	return defaultProcessor().HandleAWSCatalogue(ctx, s3)
+}
+
+// ParseVideoOutputs parses a comma separated list of output formats, see Processor.ParseVideoOutputs
+func ParseVideoOutputs(raw string) ([]string, error) {
+	return defaultProcessor().ParseVideoOutputs(raw)
+}
+
+// CreateImageServer creates an image server using the package configuration, see Processor.CreateImageServer
+func CreateImageServer(r *gin.Engine) *gin.RouterGroup {
+	return defaultProcessor().CreateImageServer(r)
+}
+
+// CreateProbeServer exposes media probing over HTTP, see Processor.CreateProbeServer
+func CreateProbeServer(r *gin.Engine, config *Configuration) *gin.RouterGroup {
+	return NewProcessor(config, Store, nil).CreateProbeServer(r)
+}
@@ -0,0 +1,145 @@
+package vod
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// stderrTailLines is the number of ffmpeg log lines kept to describe failures
+	stderrTailLines = 5
+	// maxStderrLine is the longest line of ffmpeg output which is read, longer lines end the parsing
+	maxStderrLine = 1 << 20
+)
+
+// Progress describes how far an ffmpeg process has come.
+// Time is the position reached in the output in seconds, and Percent is computed against the input duration and is 0
+// when the duration is unknown.
+type Progress struct {
+	Frame   int64   `json:"frame"`
+	Time    float64 `json:"time"`
+	Speed   float64 `json:"speed"`
+	Percent float64 `json:"percent"`
+	Done    bool    `json:"done"`
+}
+
+// ProgressFunc receives progress updates from a running ffmpeg process
+type ProgressFunc func(Progress)
+
+// runCommand runs the ffmpeg or ffprobe command and reports its progress.
+// When onProgress is set, ffmpeg is asked to write progress blocks to stderr which are parsed as they arrive.
+// duration is the length of the input in seconds.
+// The command and any process it started are killed when the context is cancelled, and the context error is returned.
+// Failures of the command itself are reported as ErrEncoderFailed.
+func runCommand(ctx context.Context, cmd *exec.Cmd, duration float64, onProgress ProgressFunc) error {
+	if onProgress != nil {
+		// -progress is a global option, so it is placed before any input or output
+		cmd.Args = append([]string{cmd.Args[0], "-progress", "pipe:2", "-nostats"}, cmd.Args[1:]...)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	setProcessGroup(cmd)
+	err = cmd.Start()
+	if err != nil {
+		return newError(ErrEncoderFailed, err)
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-stopped:
+		}
+	}()
+
+	var tail []string
+	current := Progress{}
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(nil, maxStderrLine)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 || strings.ContainsAny(pair[0], " \t") {
+			tail = append(tail, line)
+			if len(tail) > stderrTailLines {
+				tail = tail[1:]
+			}
+			continue
+		}
+
+		key, value := pair[0], strings.TrimSpace(pair[1])
+		switch key {
+		case "frame":
+			current.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "out_time_us", "out_time_ms":
+			// Both keys are reported in microseconds
+			micros, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && micros >= 0 {
+				current.Time = (time.Duration(micros) * time.Microsecond).Seconds()
+			}
+		case "speed":
+			current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			current.Done = value == "end"
+			current.Percent = progressPercent(current, duration)
+			if onProgress != nil {
+				onProgress(current)
+			}
+		}
+	}
+	// ffmpeg blocks once the pipe is full, so what is left of its output is read even when it cannot be parsed
+	io.Copy(ioutil.Discard, stderr)
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if len(tail) > 0 {
+			return newError(ErrEncoderFailed, fmt.Errorf("%w: %s", err, strings.Join(tail, "; ")))
+		}
+		return newError(ErrEncoderFailed, err)
+	}
+	return nil
+}
+
+func progressPercent(p Progress, duration float64) float64 {
+	if p.Done {
+		return 100
+	}
+	if duration <= 0 {
+		return 0
+	}
+	percent := p.Time / duration * 100
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// scanLines splits ffmpeg output into lines ended by a newline or a carriage return, which ends its status lines
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
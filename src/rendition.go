@@ -0,0 +1,105 @@
+package vod
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Rendition is a concrete output size planned for a source video.
+// Width and height follow the display orientation of the source, so portrait sources produce portrait renditions.
+type Rendition struct {
+	Name    string `json:"name"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bitrate int    `json:"bitrate"`
+}
+
+// PlanRenditions returns the renditions to produce for the probed video, largest first.
+func PlanRenditions(info *MediaInfo) ([]Rendition, error) {
+	if info == nil || len(info.Video) == 0 {
+		return nil, errNoVideoStream
+	}
+	stream := info.Video[0]
+	return planRenditions(Dimension{width: stream.Width, height: stream.Height}, stream.Rotation)
+}
+
+// planRenditions picks every size in VideoArray which fits within the short edge of the source and scales
+// the long edge to keep the aspect ratio of the source. Sources are never upscaled, so a source smaller
+// than every size produces a single rendition of its own size.
+// rotation is the clockwise rotation of the source in degrees. ffmpeg rotates frames before scaling them,
+// so sources rotated by a quarter turn are planned with their sides swapped.
+func planRenditions(source Dimension, rotation int) ([]Rendition, error) {
+	if source.width <= 10 || source.height <= 10 {
+		return nil, ErrInvalidResolution
+	}
+	width, height := source.width, source.height
+	if normalizeRotation(rotation)%180 == 90 {
+		width, height = height, width
+	}
+	shortEdge, longEdge := width, height
+	if longEdge < shortEdge {
+		shortEdge, longEdge = longEdge, shortEdge
+	}
+
+	var renditions []Rendition
+	for _, size := range VideoArray {
+		if size > shortEdge {
+			continue
+		}
+		name := strconv.Itoa(size) + "p"
+		renditions = append(renditions, newRendition(name, size, scaleEdge(longEdge, size, shortEdge), width < height, VideoBitrates[name]))
+	}
+	if len(renditions) == 0 {
+		smallest := VideoArray[len(VideoArray)-1]
+		size := evenEdge(shortEdge)
+		renditions = append(renditions, newRendition(fmt.Sprintf("%dp", size), size, evenEdge(longEdge), width < height, VideoBitrates[strconv.Itoa(smallest)+"p"]))
+	}
+	return renditions, nil
+}
+
+func newRendition(name string, shortEdge, longEdge int, portrait bool, bitrate int) Rendition {
+	if portrait {
+		return Rendition{Name: name, Width: shortEdge, Height: longEdge, Bitrate: bitrate}
+	}
+	return Rendition{Name: name, Width: longEdge, Height: shortEdge, Bitrate: bitrate}
+}
+
+// scaleEdge scales the edge by size/reference and rounds it to an even number, as required by yuv420p
+func scaleEdge(edge, size, reference int) int {
+	return evenEdge(int(math.Round(float64(edge) * float64(size) / float64(reference))))
+}
+
+func evenEdge(edge int) int {
+	return edge - edge%2
+}
+
+// fitRendition returns the display size of the source scaled to fit within the box without upscaling.
+// The box is turned to match the orientation of the source.
+func fitRendition(source Dimension, rotation int, box Dimension) (Dimension, error) {
+	if source.width <= 10 || source.height <= 10 {
+		return Dimension{}, ErrInvalidResolution
+	}
+	width, height := source.width, source.height
+	if normalizeRotation(rotation)%180 == 90 {
+		width, height = height, width
+	}
+	if (width < height) != (box.width < box.height) {
+		box.width, box.height = box.height, box.width
+	}
+
+	scale := math.Min(float64(box.width)/float64(width), float64(box.height)/float64(height))
+	if scale > 1 {
+		scale = 1
+	}
+	return Dimension{
+		width:  evenEdge(int(math.Round(float64(width) * scale))),
+		height: evenEdge(int(math.Round(float64(height) * scale))),
+	}, nil
+}
+
+// scaleFilter returns the ffmpeg filter which scales the video to the rendition.
+// Rounding to even sizes can differ from the source aspect ratio by a pixel, which is padded.
+func (r Rendition) scaleFilter() string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", r.Width, r.Height, r.Width, r.Height)
+}
@@ -0,0 +1,440 @@
+package vod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	// GIF uploads are decoded natively, like JPEG and PNG
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// ResizeMode describes how an image is fit into the box of a preset
+type ResizeMode string
+
+const (
+	// ResizeFit scales the image to fit within the box, so the output can be smaller than the box
+	ResizeFit ResizeMode = "fit"
+	// ResizeFill scales the image to cover the box and crops what overflows it, keeping the focus in frame
+	ResizeFill ResizeMode = "fill"
+	// ResizeCover is another name for ResizeFill
+	ResizeCover ResizeMode = "cover"
+	// ResizePad scales the image to fit within the box and pads the rest of the box with the background
+	ResizePad ResizeMode = "pad"
+	// ResizeStretch scales the image to the box exactly, without keeping its aspect ratio
+	ResizeStretch ResizeMode = "stretch"
+
+	// defaultJPEGQuality is the quality of natively encoded JPEG outputs whose preset has none
+	defaultJPEGQuality = 85
+	// defaultMaxImagePixels bounds the size of decoded images when the configuration does not
+	defaultMaxImagePixels = 50000000
+)
+
+var (
+	// errNativeUnsupported is returned when an image has to be resized with ffmpeg
+	errNativeUnsupported = errors.New("Image cannot be resized natively")
+)
+
+// resampleKernel weighs source pixels by their distance to the sampled position
+type resampleKernel struct {
+	support float64
+	at      func(x float64) float64
+}
+
+var (
+	// lanczos3 keeps downscaled images sharp
+	lanczos3 = resampleKernel{support: 3, at: func(x float64) float64 {
+		x = math.Abs(x)
+		if x == 0 {
+			return 1
+		}
+		if x >= 3 {
+			return 0
+		}
+		return sinc(x) * sinc(x/3)
+	}}
+	// catmullRom rings less than lanczos3 when images are enlarged
+	catmullRom = resampleKernel{support: 2, at: func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return (1.5*x-2.5)*x*x + 1
+		}
+		if x < 2 {
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}}
+)
+
+func sinc(x float64) float64 {
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func validResizeMode(mode ResizeMode) bool {
+	switch mode {
+	case "", ResizeFit, ResizeFill, ResizeCover, ResizePad, ResizeStretch:
+		return true
+	}
+	return false
+}
+
+// resizeMode returns the mode of the preset, padding by default like earlier releases
+func (p Preset) resizeMode() ResizeMode {
+	switch p.Fit {
+	case "":
+		return ResizePad
+	case ResizeCover:
+		return ResizeFill
+	}
+	return p.Fit
+}
+
+// resizeGeometry returns the size the source is scaled to and the size of the output for the box and mode
+func resizeGeometry(source, box image.Point, mode ResizeMode) (scaled, output image.Point) {
+	if mode == ResizeStretch {
+		return box, box
+	}
+	scaleX := float64(box.X) / float64(source.X)
+	scaleY := float64(box.Y) / float64(source.Y)
+	scale := math.Min(scaleX, scaleY)
+	if mode == ResizeFill {
+		scale = math.Max(scaleX, scaleY)
+	}
+	scaled = image.Pt(scaledEdge(source.X, scale), scaledEdge(source.Y, scale))
+	if mode == ResizeFit {
+		return scaled, scaled
+	}
+	return scaled, box
+}
+
+func scaledEdge(edge int, scale float64) int {
+	result := int(math.Round(float64(edge) * scale))
+	if result < 1 {
+		return 1
+	}
+	return result
+}
+
+// resizeImage scales the image into the box of the preset with its mode, background and focus.
+// A box with a zero edge keeps the size of the source.
+func resizeImage(src image.Image, preset Preset) image.Image {
+	box := image.Pt(preset.Width, preset.Height)
+	if box.X <= 0 || box.Y <= 0 {
+		return src
+	}
+	mode := preset.resizeMode()
+	scaled, output := resizeGeometry(src.Bounds().Size(), box, mode)
+	resized := resample(src, scaled)
+	if mode == ResizeFill {
+		crop := cropOffset(resized, box, preset.Focus)
+		return resized.SubImage(image.Rectangle{Min: crop, Max: crop.Add(box)})
+	}
+	if mode != ResizePad {
+		return resized
+	}
+
+	var result *image.RGBA
+	background, blur, _ := parseBackground(preset.Background)
+	if blur {
+		result = blurredBackground(src, box)
+	} else {
+		result = image.NewRGBA(image.Rectangle{Max: output})
+		draw.Draw(result, result.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	// The scaled image is centered, which pads it evenly
+	offset := image.Pt((output.X-scaled.X)/2, (output.Y-scaled.Y)/2)
+	draw.Draw(result, image.Rectangle{Min: offset, Max: offset.Add(scaled)}, resized, image.Point{}, draw.Over)
+	return result
+}
+
+// resample scales the image to size with a separable filter, resizing rows and then columns
+func resample(src image.Image, size image.Point) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rectangle{Max: bounds.Size()})
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	source := bounds.Size()
+	if source == size {
+		return rgba
+	}
+
+	// Values are kept as floats between the passes to avoid rounding twice
+	columns := resampleWeights(source.X, size.X)
+	rows := resampleWeights(source.Y, size.Y)
+	horizontal := make([]float32, size.X*source.Y*4)
+	parallelRows(source.Y, func(y int) {
+		line := rgba.Pix[y*rgba.Stride:]
+		out := horizontal[y*size.X*4:]
+		for x, weights := range columns {
+			var r, g, b, a float32
+			for i, w := range weights.values {
+				pixel := line[(weights.start+i)*4:]
+				r += w * float32(pixel[0])
+				g += w * float32(pixel[1])
+				b += w * float32(pixel[2])
+				a += w * float32(pixel[3])
+			}
+			out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = r, g, b, a
+		}
+	})
+
+	result := image.NewRGBA(image.Rectangle{Max: size})
+	parallelRows(size.Y, func(y int) {
+		weights := rows[y]
+		out := result.Pix[y*result.Stride:]
+		for x := 0; x < size.X; x++ {
+			var r, g, b, a float32
+			for i, w := range weights.values {
+				pixel := horizontal[((weights.start+i)*size.X+x)*4:]
+				r += w * pixel[0]
+				g += w * pixel[1]
+				b += w * pixel[2]
+				a += w * pixel[3]
+			}
+			// Premultiplied color cannot exceed alpha
+			alpha := clampChannel(a)
+			out[x*4+3] = alpha
+			out[x*4] = minChannel(clampChannel(r), alpha)
+			out[x*4+1] = minChannel(clampChannel(g), alpha)
+			out[x*4+2] = minChannel(clampChannel(b), alpha)
+		}
+	})
+	return result
+}
+
+// resampleWeight holds the weights of the source pixels from start which make up an output pixel
+type resampleWeight struct {
+	start  int
+	values []float32
+}
+
+// resampleWeights returns the weights of each output pixel when an edge of source pixels is scaled to size
+func resampleWeights(source, size int) []resampleWeight {
+	kernel := lanczos3
+	if size > source {
+		kernel = catmullRom
+	}
+	scale := float64(source) / float64(size)
+	// The kernel is stretched when downscaling so that every source pixel contributes
+	stretch := math.Max(scale, 1)
+	support := kernel.support * stretch
+
+	weights := make([]resampleWeight, size)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		if start < 0 {
+			start = 0
+		}
+		if end > source-1 {
+			end = source - 1
+		}
+
+		values := make([]float32, end-start+1)
+		var total float64
+		for j := range values {
+			w := kernel.at((float64(start+j) - center) / stretch)
+			values[j] = float32(w)
+			total += w
+		}
+		if total != 0 {
+			for j := range values {
+				values[j] /= float32(total)
+			}
+		}
+		weights[i] = resampleWeight{start: start, values: values}
+	}
+	return weights
+}
+
+// parallelRows calls fn for every row, spreading rows across the processors
+func parallelRows(rows int, fn func(y int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > rows {
+		workers = rows
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for y := worker; y < rows; y += workers {
+				fn(y)
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func clampChannel(value float32) uint8 {
+	if value <= 0 {
+		return 0
+	}
+	if value >= 255 {
+		return 255
+	}
+	return uint8(value + 0.5)
+}
+
+func minChannel(value, limit uint8) uint8 {
+	if value > limit {
+		return limit
+	}
+	return value
+}
+
+// nativeContainer checks if the preset can be encoded without ffmpeg
+func (p Preset) nativeContainer() bool {
+	container := p.container()
+	codec := p.Codec
+	return (container == "jpg" && (codec == "" || codec == "mjpeg")) || (container == "png" && (codec == "" || codec == "png"))
+}
+
+// resizeNative turns the image upright and resizes it with the preset in Go.
+// errNativeUnsupported is returned when Go cannot decode the image.
+func resizeNative(data []byte, preset Preset) (image.Image, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errNativeUnsupported
+	}
+	return resizeImage(orientImage(src, imageOrientation(data)), preset), nil
+}
+
+// encodeNative encodes the image resized from data with the preset in Go, keeping the ICC color profile of data
+func encodeNative(resized image.Image, data []byte, output io.Writer, preset Preset) error {
+	var encoded bytes.Buffer
+	var err error
+	if preset.container() == "png" {
+		err = png.Encode(&encoded, resized)
+	} else {
+		err = jpeg.Encode(&encoded, resized, &jpeg.Options{Quality: jpegQuality(preset.Quality)})
+	}
+	if err != nil {
+		return err
+	}
+	result, err := embedICC(encoded.Bytes(), findICC(data))
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(result)
+	return err
+}
+
+// orientImage applies the EXIF orientation, so that the image is upright without it
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	size := image.Pt(width, height)
+	if orientation >= 5 {
+		size = image.Pt(height, width)
+	}
+
+	// source returns the pixel of the source displayed at x, y
+	source := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return width - 1 - x, y },
+		3: func(x, y int) (int, int) { return width - 1 - x, height - 1 - y },
+		4: func(x, y int) (int, int) { return x, height - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, height - 1 - x },
+		7: func(x, y int) (int, int) { return width - 1 - y, height - 1 - x },
+		8: func(x, y int) (int, int) { return width - 1 - y, x },
+	}[orientation]
+
+	result := image.NewRGBA(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			sx, sy := source(x, y)
+			result.Set(x, y, src.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return result
+}
+
+// orientationFilter returns the ffmpeg filter which applies the EXIF orientation, or an empty filter when the
+// image is upright
+func orientationFilter(orientation int) string {
+	return map[int]string{
+		2: "hflip",
+		3: "hflip,vflip",
+		4: "vflip",
+		5: "transpose=0",
+		6: "transpose=1",
+		7: "transpose=3",
+		8: "transpose=2",
+	}[orientation]
+}
+
+// jpegQuality converts the JPEG scale of ffmpeg, from 2 for the best quality to 31 for the worst,
+// to the quality of the Go encoder from 100 to 1
+func jpegQuality(scale int) int {
+	if scale <= 0 {
+		return defaultJPEGQuality
+	}
+	quality := 100 - (scale-2)*100/29
+	if quality < 1 {
+		return 1
+	}
+	if quality > 100 {
+		return 100
+	}
+	return quality
+}
+
+// imageOutputSize returns the size of the image encoded with the preset, or zeros when the image cannot be decoded
+func imageOutputSize(data []byte, preset Preset) (int, int) {
+	box := image.Pt(preset.Width, preset.Height)
+	if box.X > 0 && box.Y > 0 && preset.resizeMode() != ResizeFit {
+		return box.X, box.Y
+	}
+	meta := readImageMetadata(data)
+	if meta == nil || meta.Width == 0 || meta.Height == 0 {
+		return 0, 0
+	}
+	if box.X <= 0 || box.Y <= 0 {
+		return meta.Width, meta.Height
+	}
+	_, output := resizeGeometry(image.Pt(meta.Width, meta.Height), box, ResizeFit)
+	return output.X, output.Y
+}
+
+// scaleFilter returns the ffmpeg filter which resizes stills into the box of the preset like resizeImage,
+// or an empty filter when the preset keeps the size of the source
+func (p Preset) scaleFilter() string {
+	if p.Width == 0 || p.Height == 0 {
+		return ""
+	}
+	switch p.resizeMode() {
+	case ResizeFit:
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", p.Width, p.Height)
+	case ResizeFill:
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,%s", p.Width, p.Height, p.cropFilter())
+	case ResizeStretch:
+		return fmt.Sprintf("scale=%d:%d", p.Width, p.Height)
+	}
+	if p.Background == "" {
+		return p.padFilter()
+	}
+	background, blur, _ := parseBackground(p.Background)
+	if blur {
+		// The image is laid over a blurred copy which covers the box
+		return fmt.Sprintf("split[bg][fg];[bg]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,boxblur=20[blurred];"+
+			"[fg]scale=%d:%d:force_original_aspect_ratio=decrease[scaled];[blurred][scaled]overlay=(W-w)/2:(H-h)/2",
+			p.Width, p.Height, p.Width, p.Height, p.Width, p.Height)
+	}
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=0x%02x%02x%02x%02x",
+		p.Width, p.Height, p.Width, p.Height, background.R, background.G, background.B, background.A)
+}
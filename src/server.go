@@ -1,10 +1,10 @@
 package vod
 
 import (
+	"crypto/rsa"
 	"encoding/json"
 	"log"
 	"os"
-	"path/filepath"
 )
 
 // Configuration describes the configuration settings acceptable by the application.
@@ -18,7 +18,10 @@ type Configuration struct {
 	}
 	ServerMode    string `json:"serverMode"`
 	MaxUploadSize int64  `json:"maxUploadSize"`
-	AWS           struct {
+	// MaxImagePixels bounds the width times height of images which are decoded, defaulting to 50 megapixels,
+	// so that small but highly compressed images cannot exhaust memory
+	MaxImagePixels int64 `json:"maxImagePixels"`
+	AWS            struct {
 		AccessKeyID         string `json:"accessKeyID"`
 		AccessKeySecret     string `json:"accessKeySecret"`
 		SessionToken        string `json:"sessionToken"`
@@ -28,6 +31,92 @@ type Configuration struct {
 		MediaPrefixName     string `json:"mediaPrefix"`
 		CataloguePrefixName string `json:"cataloguePrefix"`
 	}
+	// Video configures the outputs produced for uploaded videos.
+	// Outputs can contain "mp4", "hls" and "cmaf". SegmentDuration is the HLS segment length in seconds.
+	Video struct {
+		Outputs         []string `json:"outputs"`
+		SegmentDuration int      `json:"segmentDuration"`
+		// Metadata stores the probe result of each video as metadata.json next to its outputs.
+		Metadata bool `json:"metadata"`
+	} `json:"video"`
+	// Presets lists the images, videos and thumbnails produced for every upload.
+	Presets Presets `json:"presets"`
+	// Jobs configures the background processing of uploads received by the server.
+	// Workers is the number of jobs processed at once and QueueSize is the number of jobs allowed to wait.
+	// Path is the directory where jobs are recorded. Jobs are only kept in memory when it is empty.
+	// Timeout is the number of seconds a job may run before it is interrupted, with 0 allowing jobs to run until they end.
+	// Retention is the number of seconds jobs are kept once they end, defaulting to a day.
+	Jobs struct {
+		Workers   int    `json:"workers"`
+		QueueSize int    `json:"queueSize"`
+		Path      string `json:"path"`
+		Timeout   int    `json:"timeout"`
+		Retention int    `json:"retention"`
+	} `json:"jobs"`
+	// Delivery configures who can read outputs. Visibility is "public" or "private" and applies to outputs
+	// whose preset does not set its own, defaulting to public. Private outputs are read with signed URLs, which
+	// are valid for URLExpiration seconds and signed with the CloudFront key pair when CloudFront.Domain is set.
+	// Signed URLs are only issued to the Clients, each for the outputs under its key prefixes.
+	Delivery struct {
+		Visibility    string           `json:"visibility"`
+		URLExpiration int              `json:"urlExpiration"`
+		Clients       []DeliveryClient `json:"clients"`
+		CloudFront    struct {
+			Domain         string `json:"domain"`
+			KeyPairID      string `json:"keyPairId"`
+			PrivateKeyPath string `json:"privateKeyPath"`
+
+			privateKey *rsa.PrivateKey
+		} `json:"cloudfront"`
+	} `json:"delivery"`
+	// Uploads configures the forms issued for uploads sent straight to the input bucket.
+	// Expiration is the number of seconds a form can be used, defaulting to 15 minutes.
+	Uploads struct {
+		Expiration int `json:"expiration"`
+	} `json:"uploads"`
+	// Tus configures resumable uploads. Path is the directory where uploads are staged until they are complete,
+	// and Expiration is the number of seconds an unfinished upload is kept, defaulting to a day.
+	Tus struct {
+		Path       string `json:"path"`
+		Expiration int    `json:"expiration"`
+	} `json:"tus"`
+	// Dedup reuses the outputs of an earlier upload with the same content instead of processing it again.
+	// Uploads are identified by their SHA-256 checksum, indexed under Prefix in the output bucket.
+	Dedup struct {
+		Enabled bool   `json:"enabled"`
+		Prefix  string `json:"prefix"`
+	} `json:"dedup"`
+	// Webhooks lists the endpoints notified when jobs are accepted, outputs are stored and jobs complete or fail.
+	// Failed deliveries are retried Retries times, defaulting to 3, waiting Backoff milliseconds before the first retry
+	// and twice as long before each following one. Timeout is the number of seconds a delivery may take.
+	Webhooks struct {
+		Targets []WebhookTarget `json:"targets"`
+		Retries int             `json:"retries"`
+		Backoff int             `json:"backoff"`
+		Timeout int             `json:"timeout"`
+	} `json:"webhooks"`
+	// Privacy removes EXIF, XMP and IPTC metadata, such as locations and camera serial numbers, from every image
+	// output including copies of the original when StripMetadata is set. Orientation and color profiles are kept.
+	Privacy struct {
+		StripMetadata bool `json:"stripMetadata"`
+	} `json:"privacy"`
+	// Transform configures GET /findapp/img/:id, which resizes catalogue images on request from the copy of their
+	// upload. Requests must be signed with Secret, see Processor.SignImageURL, or match one of Allowed, which only
+	// serves public images. Results are cached in CachePath up to CacheSize bytes, a gigabyte by default, and clients
+	// may cache them for MaxAge seconds, a day by default.
+	Transform struct {
+		Secret    string           `json:"secret"`
+		Allowed   []ImageTransform `json:"allowed"`
+		CachePath string           `json:"cachePath"`
+		CacheSize int64            `json:"cacheSize"`
+		MaxAge    int              `json:"maxAge"`
+	} `json:"transform"`
+	// Storage selects where media is read from and written to.
+	// Driver can be "s3" or "local". Path is the root directory used by local storage.
+	Storage struct {
+		Driver string `json:"driver"`
+		Path   string `json:"path"`
+	} `json:"storage"`
 }
 
 var (
@@ -54,19 +143,58 @@ func LoadConfig(path string) *Configuration {
 		log.Fatal(err)
 		panic("Cannot continue without config file")
 	}
+	err = Config.Presets.Validate()
+	if err != nil {
+		log.Fatal(err)
+		panic("Cannot continue with invalid presets")
+	}
+	if !validVisibility(Config.Delivery.Visibility) {
+		log.Fatalf("Unknown delivery visibility(%s)", Config.Delivery.Visibility)
+		panic("Cannot continue with invalid delivery")
+	}
+	for _, client := range Config.Delivery.Clients {
+		err = client.Validate()
+		if err != nil {
+			log.Fatal(err)
+			panic("Cannot continue with invalid delivery")
+		}
+	}
+	err = Config.LoadCloudFrontKey()
+	if err != nil {
+		log.Fatal(err)
+		panic("Cannot continue without the CloudFront key")
+	}
+	for _, target := range Config.Webhooks.Targets {
+		err = target.Validate()
+		if err != nil {
+			log.Fatal(err)
+			panic("Cannot continue with invalid webhooks")
+		}
+	}
+	for _, transform := range Config.Transform.Allowed {
+		err = transform.Validate()
+		if err != nil {
+			log.Fatal(err)
+			panic("Cannot continue with invalid transforms")
+		}
+	}
 	return Config
 }
 
-func init() {
-	dir, err := os.Getwd()
+// Initialize loads the configuration at path and creates the AWS session and storage backend used by the package
+func Initialize(path string) error {
+	Config = LoadConfig(path)
+
+	sess, err := NewAWSSession(Config)
 	if err != nil {
-		log.Fatal("Cannot continue with application if I cannot find the current working directory", err)
+		return err
 	}
-	path, err := filepath.Abs(dir + "/config.json")
+	AWSSession = sess
+
+	store, err := NewStorage(Config)
 	if err != nil {
-		log.Fatal("Cannot continue with application", err)
+		return err
 	}
-	Config = LoadConfig(path)
-
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	Store = store
+	return nil
 }
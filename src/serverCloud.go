@@ -1,14 +1,13 @@
 package vod
 
 import (
+	"context"
 	"io"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 var (
@@ -16,59 +15,80 @@ var (
 	AWSSession *session.Session
 )
 
-func downloadData(inputKey string, result io.WriterAt, bucket string) error {
-	downloader := s3manager.NewDownloader(AWSSession)
-	_, err := downloader.Download(result, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(inputKey),
-	})
+func (p *Processor) downloadData(ctx context.Context, inputKey string, result io.Writer, bucket string) error {
+	data, err := p.Store.Get(ctx, bucket, inputKey)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	_, err = io.Copy(result, &contextReader{ctx: ctx, reader: data})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func copyData(inputKey, outputKey, contentType string) error {
-	client := s3.New(AWSSession)
-	_, err := client.CopyObject(&s3.CopyObjectInput{
-		Bucket:      aws.String(Config.AWS.OutputBucketName),
-		CopySource:  aws.String(Config.AWS.InputBucketName + "/" + inputKey),
-		Key:         aws.String(outputKey),
-		ACL:         aws.String("public-read"),
-		ContentType: aws.String(contentType),
-	})
+func (p *Processor) copyData(ctx context.Context, inputKey, outputKey string, opts PutOptions) error {
+	err := p.Store.Copy(ctx, p.Config.AWS.InputBucketName, inputKey, p.Config.AWS.OutputBucketName, outputKey, opts)
 	if err != nil {
 		return err
 	}
-	// No need to wait for copy to complete
-	//err = svc.WaitUntilObjectExists(&s3.HeadObjectInput{Bucket: aws.String(Config.AWS.OutputBucketName), Key: aws.String(outputKey)})
 	return nil
 }
 
-func completeRequest(data io.Reader, contentType string, path string) error {
-	uploader := s3manager.NewUploader(AWSSession)
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(Config.AWS.OutputBucketName),
-		Key:         aws.String(path),
-		ACL:         aws.String("public-read"),
-		Body:        data,
-		ContentType: aws.String(contentType),
-	})
+func (p *Processor) completeRequest(ctx context.Context, data io.Reader, opts PutOptions, path string) error {
+	err := p.Store.Put(ctx, p.Config.AWS.OutputBucketName, path, data, opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func init() {
-	awsID := os.Getenv(Config.AWS.AccessKeyID)
-	awsSecret := os.Getenv(Config.AWS.AccessKeySecret)
+// streamRequest uploads the output of encode to path while it is being written.
+// encode writes into a pipe which is read by the upload, so only the parts being uploaded are held in memory.
+// The context passed to encode is cancelled if the upload fails, and the upload is abandoned if encode fails.
+func (p *Processor) streamRequest(ctx context.Context, opts PutOptions, path string, encode func(context.Context, io.Writer) error) error {
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reader, writer := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := p.completeRequest(uploadCtx, reader, opts, path)
+		if err != nil {
+			// Unblock and stop the encoder, which has nowhere to write
+			reader.CloseWithError(err)
+			cancel()
+		}
+		uploaded <- err
+	}()
+
+	encodeErr := encode(uploadCtx, writer)
+	writer.CloseWithError(encodeErr)
+	uploadErr := <-uploaded
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if encodeErr != nil && encodeErr != context.Canceled {
+		return encodeErr
+	}
+	if uploadErr != nil {
+		return uploadErr
+	}
+	return encodeErr
+}
+
+// NewAWSSession creates the AWS session described by the configuration.
+// Credentials are read from the environment variables named in the configuration.
+func NewAWSSession(config *Configuration) (*session.Session, error) {
+	awsID := os.Getenv(config.AWS.AccessKeyID)
+	awsSecret := os.Getenv(config.AWS.AccessKeySecret)
 	creds := credentials.NewStaticCredentials(awsID, awsSecret, "")
 
-	config := &aws.Config{
+	return session.NewSession(&aws.Config{
 		Credentials: creds,
-		Region:      aws.String(Config.AWS.Region),
-	}
-	sess := session.Must(session.NewSession(config))
-	AWSSession = sess
+		Region:      aws.String(config.AWS.Region),
+	})
 }
@@ -0,0 +1,102 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrObjectNotFound is returned by storage backends when the requested object does not exist
+	ErrObjectNotFound = errors.New("Object does not exist")
+)
+
+// ObjectInfo describes an object held by a storage backend.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+const (
+	// ACLPublicRead lets anyone read the object
+	ACLPublicRead = "public-read"
+	// ACLPrivate only lets the owner of the bucket read the object
+	ACLPrivate = "private"
+)
+
+// PutOptions describes how an object should be written to a storage backend.
+// ACL is a canned ACL such as ACLPublicRead, with an empty ACL leaving the default of the bucket.
+// Backends without access control ignore it.
+type PutOptions struct {
+	ContentType string
+	ACL         string
+}
+
+// UploadForm describes a form which uploads a file straight to a storage backend.
+// Fields are sent as a multipart form to URL, followed by the file in a final field named "file".
+type UploadForm struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// Presigner is implemented by storage backends which let clients upload objects without going through the service.
+type Presigner interface {
+	// PresignUpload returns a form which uploads a single object to the key until it expires.
+	// The backend rejects uploads larger than maxSize or with a content type other than the one in opts.
+	PresignUpload(ctx context.Context, bucket, key string, maxSize int64, opts PutOptions, expires time.Duration) (*UploadForm, error)
+}
+
+// URLSigner is implemented by storage backends which issue URLs to read private objects.
+type URLSigner interface {
+	// PresignGet returns a URL which reads the object until it expires
+	PresignGet(ctx context.Context, bucket, key string, expires time.Duration) (string, error)
+}
+
+// Storage abstracts the object store used for reading uploads and writing processed outputs.
+// Objects are addressed by bucket and key, so input and output locations can differ.
+// Operations stop when the context is cancelled.
+type Storage interface {
+	// Get opens the object for reading. The caller must close the returned reader.
+	Get(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// Put writes data to the object, replacing any existing content.
+	Put(ctx context.Context, bucket, key string, data io.Reader, opts PutOptions) error
+	// Copy copies an object to a new location, possibly in another bucket.
+	Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts PutOptions) error
+	// Stat returns information about the object without reading it.
+	Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, bucket, key string) error
+	// List returns every object in the bucket whose key starts with prefix.
+	List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+}
+
+var (
+	// Store is the storage backend used by the processing pipeline
+	Store Storage
+)
+
+// NewStorage returns the storage backend selected in the configuration.
+// S3 is used when no driver is specified, with AWSSession or a new session when it is not set.
+func NewStorage(config *Configuration) (Storage, error) {
+	switch strings.ToLower(config.Storage.Driver) {
+	case "", "s3":
+		sess := AWSSession
+		if sess == nil {
+			var err error
+			sess, err = NewAWSSession(config)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewS3Storage(sess), nil
+	case "local":
+		return NewLocalStorage(config.Storage.Path)
+	default:
+		return nil, fmt.Errorf("Unknown storage driver(%s)", config.Storage.Driver)
+	}
+}
@@ -0,0 +1,222 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage stores objects on the local filesystem.
+// Each bucket is a directory below the root and keys map to relative file paths.
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage returns a storage backend rooted at the provided directory
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, errors.New("Local storage requires a path")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{root: root}, nil
+}
+
+// bucketPath returns the directory of the bucket.
+// Buckets are single directories below the root, so names which are paths or point elsewhere are rejected.
+func (l *LocalStorage) bucketPath(bucket string) (string, error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", errors.New("Invalid object location")
+	}
+	return filepath.Join(l.root, bucket), nil
+}
+
+// filePath returns the location of the object on disk.
+// Keys cannot escape the bucket directory.
+func (l *LocalStorage) filePath(bucket, key string) (string, error) {
+	bucketRoot, err := l.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	cleanKey := path.Clean("/" + key)
+	if cleanKey == "/" {
+		return "", errors.New("Invalid object location")
+	}
+	return filepath.Join(bucketRoot, filepath.FromSlash(cleanKey)), nil
+}
+
+// Get opens the object for reading
+func (l *LocalStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	name, err := l.filePath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return file, err
+}
+
+// Put writes data to the object.
+// Data is written to a temporary file first so readers never see partial objects.
+func (l *LocalStorage) Put(ctx context.Context, bucket, key string, data io.Reader, opts PutOptions) error {
+	name, err := l.filePath(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, &contextReader{ctx: ctx, reader: data})
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), name)
+}
+
+// Copy copies an object to a new location
+func (l *LocalStorage) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts PutOptions) error {
+	src, err := l.Get(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return l.Put(ctx, dstBucket, dstKey, src, opts)
+}
+
+// Stat returns information about the object.
+// The content type is derived from the key's extension, falling back to the object's content.
+func (l *LocalStorage) Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	name, err := l.filePath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(name)
+	if os.IsNotExist(err) || (err == nil && stat.IsDir()) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType, err = detectFileContentType(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  contentType,
+		LastModified: stat.ModTime(),
+	}, nil
+}
+
+// Delete removes the object
+func (l *LocalStorage) Delete(ctx context.Context, bucket, key string) error {
+	name, err := l.filePath(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all objects in the bucket with the given prefix, ordered by key
+func (l *LocalStorage) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	bucketRoot, err := l.bucketPath(bucket)
+	if err != nil {
+		return nil, err
+	}
+	var objects []ObjectInfo
+	err = filepath.Walk(bucketRoot, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketRoot, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// contextReader stops reading once the context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+func detectFileContentType(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
@@ -0,0 +1,227 @@
+package vod
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Storage stores objects in Amazon S3 buckets.
+type S3Storage struct {
+	session *session.Session
+	client  *s3.S3
+}
+
+// NewS3Storage returns a storage backend which uses the provided AWS session
+func NewS3Storage(sess *session.Session) *S3Storage {
+	return &S3Storage{session: sess, client: s3.New(sess)}
+}
+
+// Get opens the object for reading
+func (s *S3Storage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return result.Body, nil
+}
+
+// Put uploads data to the object
+func (s *S3Storage) Put(ctx context.Context, bucket, key string, data io.Reader, opts PutOptions) error {
+	uploader := s3manager.NewUploader(s.session)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ACL:         s3ACL(opts.ACL),
+		Body:        data,
+		ContentType: aws.String(opts.ContentType),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	return nil
+}
+
+// Copy copies an object within S3 without downloading it
+func (s *S3Storage) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts PutOptions) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(dstBucket),
+		CopySource: aws.String(s3CopySource(srcBucket, srcKey)),
+		Key:        aws.String(dstKey),
+		ACL:        s3ACL(opts.ACL),
+	}
+	// Copies keep the content type of the source unless one is given, which S3 only applies when the metadata is replaced
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	}
+	_, err := s.client.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		return s3Error(err)
+	}
+	// No need to wait for copy to complete
+	return nil
+}
+
+// s3CopySource returns the source of a copy, which S3 expects URL encoded
+func s3CopySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(url.QueryEscape(part), "+", "%20", -1)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Stat returns information about the object
+func (s *S3Storage) Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	result, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(result.ContentLength),
+		ContentType:  aws.StringValue(result.ContentType),
+		LastModified: aws.TimeValue(result.LastModified),
+	}, nil
+}
+
+// Delete removes the object
+func (s *S3Storage) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	return nil
+}
+
+// List returns all objects in the bucket with the given prefix
+func (s *S3Storage) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return objects, nil
+}
+
+// PresignGet returns a presigned GET URL for the object
+func (s *S3Storage) PresignGet(ctx context.Context, bucket, key string, expires time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+	return req.Presign(expires)
+}
+
+// PresignUpload returns a POST policy which uploads the object straight to S3.
+// Unlike a presigned PUT, the policy lets S3 enforce the size and content type of the upload.
+func (s *S3Storage) PresignUpload(ctx context.Context, bucket, key string, maxSize int64, opts PutOptions, expires time.Duration) (*UploadForm, error) {
+	creds, err := s.client.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	region := aws.StringValue(s.client.Config.Region)
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     opts.ContentType,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": creds.AccessKeyID + "/" + scope,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	conditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		[]interface{}{"content-length-range", 1, maxSize},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	signingKey := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, fields["policy"]))
+
+	return &UploadForm{URL: s.client.Endpoint + "/" + bucket, Fields: fields}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3ACL returns the canned ACL sent to S3, which is omitted when empty
+func s3ACL(acl string) *string {
+	if acl == "" {
+		return nil
+	}
+	return aws.String(acl)
+}
+
+// s3Error converts S3 specific errors into storage errors
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrObjectNotFound
+		}
+	}
+	// Throttling, timeouts and server errors are retried by the SDK and may pass once S3 recovers
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return newError(ErrStorageUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,358 @@
+package vod
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTransformMaxAge = 24 * time.Hour
+	// maxTransformSize bounds the edges of transformed images
+	maxTransformSize = 4096
+	// transformTimeout bounds a shared transform, which no request can cancel
+	transformTimeout = 2 * time.Minute
+)
+
+var (
+	// transformFormats lists the containers images can be transformed to
+	transformFormats = []string{"jpg", "png", "webp", "avif"}
+)
+
+// ImageTransform describes an image served by GET /findapp/img/:id, named after its query parameters.
+// Width and Height form the box the image is resized into as Fit describes, with 0 keeping the size of the source.
+// Format is one of jpg, png, webp and avif, and is negotiated with the Accept header when it is empty.
+// Quality ranges from 1 for the smallest output to 100 for the best, and 0 leaves the encoder default.
+type ImageTransform struct {
+	Width   int        `json:"w"`
+	Height  int        `json:"h"`
+	Fit     ResizeMode `json:"fit,omitempty"`
+	Format  string     `json:"fmt,omitempty"`
+	Quality int        `json:"q,omitempty"`
+}
+
+// parseImageTransform reads the transform from the query parameters of a request
+func parseImageTransform(query url.Values) (ImageTransform, error) {
+	var t ImageTransform
+	for name, value := range map[string]*int{"w": &t.Width, "h": &t.Height, "q": &t.Quality} {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			return t, newError(ErrInvalidRequest, fmt.Errorf("Parameter %s must be a number", name))
+		}
+		*value = parsed
+	}
+	t.Fit = ResizeMode(query.Get("fit"))
+	t.Format = Preset{Container: query.Get("fmt")}.container()
+	err := t.Validate()
+	if err != nil {
+		return t, newError(ErrInvalidRequest, err)
+	}
+	return t, nil
+}
+
+// Validate checks that the transform can be served
+func (t ImageTransform) Validate() error {
+	if t.Width < 0 || t.Height < 0 || t.Width > maxTransformSize || t.Height > maxTransformSize {
+		return fmt.Errorf("Transform dimension must be between 0 and %d", maxTransformSize)
+	}
+	if !validResizeMode(t.Fit) {
+		return fmt.Errorf("Transform has unknown fit(%s)", t.Fit)
+	}
+	if t.Quality < 0 || t.Quality > 100 {
+		return errors.New("Transform quality must be between 0 and 100")
+	}
+	if t.Format == "" {
+		return nil
+	}
+	container := Preset{Container: t.Format}.container()
+	for _, format := range transformFormats {
+		if container == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Transform has unsupported format(%s)", t.Format)
+}
+
+// query returns the query parameters of the transform in their canonical order, leaving out defaults
+func (t ImageTransform) query() url.Values {
+	query := url.Values{}
+	for name, value := range map[string]int{"w": t.Width, "h": t.Height, "q": t.Quality} {
+		if value != 0 {
+			query.Set(name, strconv.Itoa(value))
+		}
+	}
+	if t.Fit != "" {
+		query.Set("fit", string(t.Fit))
+	}
+	if t.Format != "" {
+		query.Set("fmt", Preset{Container: t.Format}.container())
+	}
+	return query
+}
+
+// allowedBy checks if the transform matches the allowed one, whose format only restricts the transform when it is set
+func (t ImageTransform) allowedBy(allowed ImageTransform) bool {
+	format := Preset{Container: allowed.Format}.container()
+	return t.Width == allowed.Width && t.Height == allowed.Height && t.Fit == allowed.Fit && t.Quality == allowed.Quality &&
+		(format == "" || format == t.Format)
+}
+
+// preset returns the preset which encodes the transform to the container
+func (t ImageTransform) preset(container string) Preset {
+	return Preset{
+		Name:      "transform",
+		Width:     t.Width,
+		Height:    t.Height,
+		Fit:       t.Fit,
+		Container: container,
+		Quality:   presetQuality(container, t.Quality),
+	}
+}
+
+// presetQuality converts a quality from 1 for the smallest output to 100 for the best to the quality of the encoder
+// of the container, see Preset
+func presetQuality(container string, quality int) int {
+	if quality <= 0 {
+		return 0
+	}
+	switch container {
+	case "jpg":
+		return 31 - (quality-1)*29/99
+	case "webp":
+		return quality
+	case "avif":
+		return 63 - quality*63/100
+	}
+	return 0
+}
+
+// SignImageURL returns the path which serves the catalogue image with the ID transformed, signed with the configured
+// secret so that it is served even when the transform is not allowed
+func (p *Processor) SignImageURL(id string, t ImageTransform) string {
+	query := t.query()
+	query.Set("sig", p.imageSignature(id, t))
+	return "/findapp/img/" + url.PathEscape(id) + "?" + query.Encode()
+}
+
+// imageSignature returns the HMAC-SHA256 signature of the transform of the image with the ID
+func (p *Processor) imageSignature(id string, t ImageTransform) string {
+	mac := hmac.New(sha256.New, []byte(p.Config.Transform.Secret))
+	mac.Write([]byte(id + "?" + t.query().Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorizeTransform checks that the transform of the image with the ID is signed, or allowed for public images
+func (p *Processor) authorizeTransform(id string, t ImageTransform, signature string, private bool) error {
+	secret := p.Config.Transform.Secret
+	if secret != "" && signature != "" {
+		if hmac.Equal([]byte(signature), []byte(p.imageSignature(id, t))) {
+			return nil
+		}
+		return newError(ErrForbidden, errors.New("Signature is invalid"))
+	}
+	if !private {
+		for _, allowed := range p.Config.Transform.Allowed {
+			if t.allowedBy(allowed) {
+				return nil
+			}
+		}
+	}
+	return newError(ErrForbidden, errors.New("Transform is not allowed"))
+}
+
+// transformPreset returns the image preset which copies uploads, which transforms are made from
+func (p *Processor) transformPreset() (Preset, bool) {
+	for _, preset := range p.imagePresets() {
+		if preset.Codec == PresetCopy {
+			return preset, true
+		}
+	}
+	return Preset{}, false
+}
+
+// transformSource returns the manifest entry of the copy of the catalogue image with the ID made by the preset
+func (p *Processor) transformSource(ctx context.Context, id string, preset Preset) (*ManifestEntry, error) {
+	root := "catalogue/" + id
+	if id == "" || strings.Contains(id, "/") || !validOutputKey(root) {
+		return nil, newError(ErrInvalidRequest, errors.New("Image ID is invalid"))
+	}
+	manifest, err := p.readManifest(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range manifest.Outputs {
+		if entry.Preset == preset.Name {
+			return &entry, nil
+		}
+	}
+	return nil, ErrObjectNotFound
+}
+
+// transformFormat returns the format the transform is encoded to, negotiated with the Accept header when the
+// transform has none. Images are served in the smallest format the client names explicitly, and otherwise as
+// PNG when their source is PNG and as JPEG for other sources.
+func transformFormat(t ImageTransform, accept, sourceType string) string {
+	if t.Format != "" {
+		return t.Format
+	}
+	for _, name := range negotiatedFormats {
+		if acceptsType(accept, containers[name].contentType) {
+			return name
+		}
+	}
+	if sourceType == containers["png"].contentType {
+		return "png"
+	}
+	return "jpg"
+}
+
+// transformKey identifies the transform of the source encoded to the format, and changes whenever the source does
+func transformKey(source *ManifestEntry, t ImageTransform, format string) string {
+	t.Format = format
+	sum := sha256.Sum256([]byte(source.Checksum + "\n" + t.query().Encode()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// transformSourceTo reads the source from storage and writes it transformed to the format to output
+func (p *Processor) transformSourceTo(ctx context.Context, source *ManifestEntry, t ImageTransform, format string, output *bytes.Buffer) error {
+	input, err := p.Store.Get(ctx, p.Config.AWS.OutputBucketName, source.Key)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	return p.encodeImage(ctx, input, output, t.preset(format))
+}
+
+// transformCall is a transform in progress, which requests for the same cache key wait for
+type transformCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// transformGroup runs a single transform for each cache key at once, sharing its result with concurrent requests
+type transformGroup struct {
+	mu    sync.Mutex
+	calls map[string]*transformCall
+}
+
+// do runs transform unless it is already running for the key, and returns its result
+func (g *transformGroup) do(key string, transform func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.data, call.err
+	}
+	call := new(transformCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.data, call.err = transform()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.data, call.err
+}
+
+// CreateTransformServer serves catalogue images transformed on request from the copy of their upload.
+// Transformed images are cached in cache and identified by their ETag, which changes with the source.
+func (p *Processor) CreateTransformServer(r *gin.Engine, cache *ImageCache) *gin.RouterGroup {
+	g := r.Group("/findapp")
+	transforms := &transformGroup{calls: map[string]*transformCall{}}
+
+	g.GET("/img/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id := c.Param("id")
+		transform, err := parseImageTransform(c.Request.URL.Query())
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		preset, ok := p.transformPreset()
+		if !ok {
+			respondError(c, newError(ErrNotSupported, errors.New("No image preset copies uploads")))
+			return
+		}
+		private := p.acl(preset.Visibility) == ACLPrivate
+		err = p.authorizeTransform(id, transform, c.Query("sig"), private)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		source, err := p.transformSource(ctx, id, preset)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		format := transformFormat(transform, c.GetHeader("Accept"), source.ContentType)
+		if transform.Format == "" {
+			c.Header("Vary", "Accept")
+		}
+		maxAge := time.Duration(p.Config.Transform.MaxAge) * time.Second
+		if maxAge <= 0 {
+			maxAge = defaultTransformMaxAge
+		}
+		visibility := "public"
+		if private {
+			visibility = "private"
+		}
+		etag := `"` + transformKey(source, transform, format) + `"`
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, int(maxAge.Seconds())))
+		if match := c.GetHeader("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		key := strings.Trim(etag, `"`)
+		data, ok := cache.get(key)
+		if !ok {
+			// Concurrent misses share one transform, which outlives the request that started it
+			data, err = transforms.do(key, func() ([]byte, error) {
+				if data, ok := cache.get(key); ok {
+					return data, nil
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+				defer cancel()
+				var output bytes.Buffer
+				err := p.transformSourceTo(ctx, source, transform, format, &output)
+				if err != nil {
+					return nil, err
+				}
+				err = cache.put(key, output.Bytes())
+				if err != nil {
+					log.Printf("Transformed image %s was not cached: %v", key, err)
+				}
+				return output.Bytes(), nil
+			})
+			if err != nil {
+				respondError(c, err)
+				return
+			}
+		}
+		c.Data(http.StatusOK, containers[format].contentType, data)
+	})
+
+	return g
+}
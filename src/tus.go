@@ -0,0 +1,464 @@
+package vod
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/h2non/filetype"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	// tusContentType is the content type of every PATCH request
+	tusContentType = "application/offset+octet-stream"
+
+	defaultTusExpiration = 24 * time.Hour
+)
+
+// TusStore stages resumable uploads on the local filesystem until they are complete.
+// Each upload is described by a JSON file named after its ID, with the data received so far beside it.
+// Uploads which are not completed before they expire are removed.
+type TusStore struct {
+	dir        string
+	expiration time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// tusUpload describes a resumable upload.
+// Metadata holds the Upload-Metadata header as sent by the client, which is parsed into Values.
+// Offset is the size of the data received so far and is not stored.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	MediaID   string            `json:"mediaId"`
+	Length    int64             `json:"length"`
+	Metadata  string            `json:"metadata,omitempty"`
+	Values    map[string]string `json:"values,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+
+	Offset int64 `json:"-"`
+}
+
+// NewTusStore returns a store which stages uploads in dir and keeps unfinished uploads for expiration
+func NewTusStore(dir string, expiration time.Duration) (*TusStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if expiration <= 0 {
+		expiration = defaultTusExpiration
+	}
+	return &TusStore{dir: dir, expiration: expiration, locks: map[string]*sync.Mutex{}}, nil
+}
+
+// NewTusStore returns the store of resumable uploads described by the configuration.
+// Uploads are staged in the temporary directory when no path is configured.
+func (p *Processor) NewTusStore() (*TusStore, error) {
+	dir := p.Config.Tus.Path
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "vod-tus")
+	}
+	return NewTusStore(dir, time.Duration(p.Config.Tus.Expiration)*time.Second)
+}
+
+func (s *TusStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *TusStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+// lock prevents concurrent writes to the upload and returns the function which releases it.
+// Only uploads which exist are locked, so that requests for unknown IDs add nothing to the locks.
+func (s *TusStore) lock(id string) (func(), error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	if _, err := os.Stat(s.infoPath(id)); os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	s.mu.Lock()
+	lock, ok := s.locks[id]
+	if !ok {
+		lock = new(sync.Mutex)
+		s.locks[id] = lock
+	}
+	s.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+// create starts an upload of length bytes with the metadata sent by the client
+func (s *TusStore) create(length int64, metadata string, values map[string]string) (*tusUpload, error) {
+	s.clean()
+
+	now := time.Now().UTC()
+	upload := &tusUpload{
+		ID:        uuid.New().String(),
+		MediaID:   uuid.New().String(),
+		Length:    length,
+		Metadata:  metadata,
+		Values:    values,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.expiration),
+	}
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(s.dataPath(upload.ID), nil, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(s.infoPath(upload.ID), data, 0644)
+	if err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// get returns the upload with the data received so far, or ErrUploadNotFound when it does not exist or expired
+func (s *TusStore) get(id string) (*tusUpload, error) {
+	// IDs are used as file names, so anything else is rejected
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	data, err := ioutil.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload := new(tusUpload)
+	err = json.Unmarshal(data, upload)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		s.remove(id)
+		return nil, ErrUploadNotFound
+	}
+
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset = stat.Size()
+	return upload, nil
+}
+
+// write appends data to the upload, which must have received offset bytes so far.
+// Data beyond the length of the upload is ignored. What was received is kept when reading data fails.
+func (s *TusStore) write(upload *tusUpload, offset int64, data io.Reader) error {
+	if offset != upload.Offset {
+		return ErrOffsetMismatch
+	}
+	file, err := os.OpenFile(s.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(data, upload.Length-upload.Offset))
+	upload.Offset += written
+	return err
+}
+
+// finish removes the record of the upload but keeps its data, which is then owned by the caller
+func (s *TusStore) finish(id string) {
+	os.Remove(s.infoPath(id))
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+}
+
+// remove deletes the upload and its data
+func (s *TusStore) remove(id string) {
+	s.finish(id)
+	os.Remove(s.dataPath(id))
+}
+
+// clean removes every expired upload
+func (s *TusStore) clean() {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Cannot clean expired uploads: %s", err.Error())
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		// get removes the upload once it expired
+		s.get(strings.TrimSuffix(file.Name(), ".json"))
+	}
+}
+
+// parseTusMetadata parses the Upload-Metadata header, a comma separated list of keys and base64 encoded values
+func parseTusMetadata(header string) (map[string]string, error) {
+	values := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			values[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, newError(ErrInvalidRequest, errors.New("Upload-Metadata values must be base64 encoded"))
+			}
+			values[parts[0]] = string(value)
+		default:
+			return nil, newError(ErrInvalidRequest, errors.New("Upload-Metadata is invalid"))
+		}
+	}
+	return values, nil
+}
+
+// parseTusOffset parses a header holding a size in bytes
+func parseTusOffset(c *gin.Context, header string) (int64, error) {
+	value, err := strconv.ParseInt(c.GetHeader(header), 10, 64)
+	if err != nil || value < 0 {
+		return 0, newError(ErrInvalidRequest, errors.New(header+" must be a positive number"))
+	}
+	return value, nil
+}
+
+// tusResumable sets the headers sent with every response and rejects requests for other versions of the protocol
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+// CreateTusServer accepts resumable uploads with the tus 1.0 protocol, including the creation, termination and
+// expiration extensions. Completed videos are processed by the job queue and completed images like catalogue uploads.
+func CreateTusServer(r *gin.Engine, queue *JobQueue, store *TusStore) *gin.RouterGroup {
+	p := queue.processor
+	g := r.Group("/findapp/tus")
+	g.Use(tusResumable)
+
+	options := func(c *gin.Context) {
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		if p.Config.MaxUploadSize > 0 {
+			c.Header("Tus-Max-Size", strconv.FormatInt(p.Config.MaxUploadSize, 10))
+		}
+		c.Status(http.StatusNoContent)
+	}
+	g.OPTIONS("", options)
+	g.OPTIONS("/:id", options)
+
+	g.POST("", func(c *gin.Context) {
+		if c.GetHeader("Upload-Defer-Length") != "" {
+			respondError(c, newError(ErrInvalidRequest, errors.New("Upload-Length must be provided")))
+			return
+		}
+		length, err := parseTusOffset(c, "Upload-Length")
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if length == 0 {
+			respondError(c, ErrNotMedia)
+			return
+		}
+		if p.Config.MaxUploadSize > 0 && length > p.Config.MaxUploadSize {
+			respondError(c, ErrTooLarge)
+			return
+		}
+		metadata := c.GetHeader("Upload-Metadata")
+		values, err := parseTusMetadata(metadata)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		// Outputs are checked before any data is sent
+		_, err = p.ParseVideoOutputs(values["outputs"])
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		upload, err := store.create(length, metadata, values)
+		if err != nil {
+			log.Printf(err.Error())
+			respondError(c, err)
+			return
+		}
+		c.Header("Location", "/findapp/tus/"+upload.ID)
+		c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		c.Header("Media-Id", upload.MediaID)
+		c.Status(http.StatusCreated)
+	})
+
+	g.HEAD("/:id", func(c *gin.Context) {
+		upload, err := store.get(c.Param("id"))
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		if upload.Metadata != "" {
+			c.Header("Upload-Metadata", upload.Metadata)
+		}
+		c.Status(http.StatusOK)
+	})
+
+	g.PATCH("/:id", func(c *gin.Context) {
+		if c.ContentType() != tusContentType {
+			respondError(c, newError(ErrInvalidRequest, errors.New("Content-Type must be "+tusContentType)))
+			return
+		}
+		offset, err := parseTusOffset(c, "Upload-Offset")
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		id := c.Param("id")
+		unlock, err := store.lock(id)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		defer unlock()
+		upload, err := store.get(id)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		reader := c.Request.Body
+		defer reader.Close()
+		err = store.write(upload, offset, reader)
+		if err != nil {
+			log.Printf(err.Error())
+			if !errors.Is(err, ErrOffsetMismatch) {
+				err = readError(err)
+			}
+			respondError(c, err)
+			return
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		if upload.Offset == upload.Length {
+			err = completeTusUpload(c, queue, store, upload)
+			if err != nil {
+				log.Printf(err.Error())
+				respondError(c, err)
+				return
+			}
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	g.DELETE("/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		unlock, err := store.lock(id)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		defer unlock()
+		_, err = store.get(id)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		store.remove(id)
+		c.Status(http.StatusNoContent)
+	})
+
+	return g
+}
+
+// completeTusUpload hands the completed upload to the pipeline.
+// Videos are queued as a job, which then owns the data, and images are processed before responding.
+// The upload is kept when it cannot be handed over, so the client can complete it again.
+func completeTusUpload(c *gin.Context, queue *JobQueue, store *TusStore, upload *tusUpload) error {
+	p := queue.processor
+	path := store.dataPath(upload.ID)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	head, err := bufio.NewReader(file).Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	isVideoType, videoType := IsVideo(head)
+	imageType := http.DetectContentType(head)
+	switch {
+	case filetype.IsVideo(head) || isVideoType:
+		outputs, err := p.ParseVideoOutputs(upload.Values["outputs"])
+		if err != nil {
+			return err
+		}
+		job := NewVideoJob(upload.Values["filename"], path, videoType, outputs)
+		job.MediaID = upload.MediaID
+		if p.Config.Dedup.Enabled {
+			job.Checksum, err = fileChecksum(file)
+			if err != nil {
+				return err
+			}
+		}
+		err = queue.Enqueue(job)
+		if err != nil {
+			return err
+		}
+		store.finish(upload.ID)
+		c.Header("Job-Id", job.ID)
+	case strings.HasPrefix(imageType, "image"):
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		err = p.generateImagePresets(c.Request.Context(), data, "", imageType, "catalogue/"+upload.MediaID)
+		if err != nil {
+			return err
+		}
+		store.remove(upload.ID)
+	default:
+		store.remove(upload.ID)
+		return ErrNotMedia
+	}
+	return nil
+}
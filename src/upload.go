@@ -0,0 +1,112 @@
+package vod
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultUploadExpiration = 15 * time.Minute
+	// uploadFilename is the name of direct uploads under their media or catalogue ID
+	uploadFilename = "upload"
+)
+
+// DirectUpload describes an upload sent by the client straight to the input bucket.
+// Key is laid out under the media or catalogue prefix, so the upload is processed by lambda once it arrives,
+// and Root is where its outputs are written.
+type DirectUpload struct {
+	MediaID   string            `json:"mediaId"`
+	Key       string            `json:"key"`
+	Root      string            `json:"root"`
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Fields    map[string]string `json:"fields"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// directUploadRequest is the body of POST /findapp/uploads
+type directUploadRequest struct {
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+// NewDirectUpload allocates a media ID for a video or a catalogue ID for an image of the content type,
+// and returns a form which uploads it to the input bucket.
+// The storage backend must implement Presigner.
+func (p *Processor) NewDirectUpload(ctx context.Context, contentType string, size int64) (*DirectUpload, error) {
+	presigner, ok := p.Store.(Presigner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if size <= 0 {
+		return nil, newError(ErrInvalidRequest, errors.New("Size must be provided"))
+	}
+	if p.Config.MaxUploadSize > 0 && size > p.Config.MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, newError(ErrInvalidRequest, errors.New("Content type is invalid"))
+	}
+	var prefix, root string
+	id := uuid.New().String()
+	switch {
+	case strings.HasPrefix(mediaType, "video/"):
+		prefix = p.Config.AWS.MediaPrefixName
+		root = p.MediaRoot(id)
+	case strings.HasPrefix(mediaType, "image/"):
+		prefix = p.Config.AWS.CataloguePrefixName
+		root = p.CatalogueRoot(id)
+	default:
+		return nil, ErrNotMedia
+	}
+
+	expiration := time.Duration(p.Config.Uploads.Expiration) * time.Second
+	if expiration <= 0 {
+		expiration = defaultUploadExpiration
+	}
+	key := prefix + id + "/" + uploadFilename
+	form, err := presigner.PresignUpload(ctx, p.Config.AWS.InputBucketName, key, size, PutOptions{ContentType: mediaType}, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectUpload{
+		MediaID:   id,
+		Key:       key,
+		Root:      root,
+		URL:       form.URL,
+		Method:    http.MethodPost,
+		Fields:    form.Fields,
+		ExpiresAt: time.Now().UTC().Add(expiration),
+	}, nil
+}
+
+// CreateUploadServer issues forms which let clients upload straight to the input bucket
+func (p *Processor) CreateUploadServer(r *gin.Engine) *gin.RouterGroup {
+	g := r.Group("/findapp")
+
+	g.POST("/uploads", func(c *gin.Context) {
+		request := directUploadRequest{}
+		err := c.ShouldBindJSON(&request)
+		if err != nil {
+			respondError(c, newError(ErrInvalidRequest, err))
+			return
+		}
+		upload, err := p.NewDirectUpload(c.Request.Context(), request.ContentType, request.Size)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, upload)
+	})
+
+	return g
+}
@@ -2,32 +2,28 @@ package vod
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
-	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go/aws"
-
 	"github.com/gin-gonic/gin"
 	"github.com/h2non/filetype"
 )
 
-// VideoResizeCommand resizes the video provided and writes the new file to the filesystem
-// TODO: send output to write stream
-func VideoResizeCommand(cmd *exec.Cmd, input io.Reader, output io.Writer) error {
+// VideoResizeCommand resizes the video provided and writes the new file to the filesystem.
+// Progress is reported to onProgress, if set, against the input duration in seconds.
+func VideoResizeCommand(ctx context.Context, cmd *exec.Cmd, input io.Reader, output io.Writer, duration float64, onProgress ProgressFunc) error {
 	cmd.Stdin = input
 	cmd.Stdout = output
-	err := cmd.Run()
+	err := runCommand(ctx, cmd, duration, onProgress)
 	if err != nil {
 		log.Printf("Failed to start video resize process")
 		return err
@@ -37,10 +33,11 @@ func VideoResizeCommand(cmd *exec.Cmd, input io.Reader, output io.Writer) error
 }
 
 // ThumbnailCommand generates thumbnail from video input and sets it to the output reader.
-func ThumbnailCommand(cmd *exec.Cmd, input io.Reader, output io.Writer) error {
+// Progress is reported to onProgress, if set.
+func ThumbnailCommand(ctx context.Context, cmd *exec.Cmd, input io.Reader, output io.Writer, onProgress ProgressFunc) error {
 	cmd.Stdin = input
 	cmd.Stdout = output
-	err := cmd.Run()
+	err := runCommand(ctx, cmd, 0, onProgress)
 	if err != nil {
 		log.Printf("Failed to start thumbnail process")
 		return err
@@ -50,140 +47,226 @@ func ThumbnailCommand(cmd *exec.Cmd, input io.Reader, output io.Writer) error {
 }
 
 // GetDimension returns the dimension of video from stream
-func GetDimension(video io.Reader) (*Dimension, error) {
-	cmd := exec.Command("ffprobe",
-		"-t", "3s",
-		"-i", "pipe:0",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "csv=s=x:p=0",
-	)
-
-	out := new(strings.Builder)
-	cmd.Stdin = video
-	cmd.Stdout = out
-	err := cmd.Run()
+func (p *Processor) GetDimension(ctx context.Context, video io.Reader) (*Dimension, error) {
+	info, err := p.Probe(ctx, video)
 	if err != nil {
-		log.Printf(err.Error())
 		return nil, errors.New("Error occurred while extracting dimension")
 	}
-
-	outString := out.String()
-	data := strings.Split(strings.Trim(outString, " \n"), "x")
-	x, _ := strconv.Atoi(data[0])
-	y, _ := strconv.Atoi(data[1])
-	result := Dimension{width: x, height: y}
-
-	if result.height <= 10 || result.width <= 10 {
-		return nil, errors.New("Input file has invalid resolution")
-	}
-
-	return &result, nil
+	return info.Dimension()
 }
 
 // GetDuration returns the duration of video from stream
-func GetDuration(video io.Reader) (float64, error) {
-	cmd := exec.Command("ffprobe",
-		"-i", "pipe:0",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-	)
-
-	out := new(strings.Builder)
-	cmd.Stdin = video
-	cmd.Stdout = out
-	err := cmd.Run()
+func (p *Processor) GetDuration(ctx context.Context, video io.Reader) (float64, error) {
+	info, err := p.Probe(ctx, video)
 	if err != nil {
-		log.Printf(err.Error())
 		return 0, err
 	}
-	outString := out.String()
-	durationSeconds, err := strconv.ParseFloat(strings.Trim(outString, " \n"), 32)
-	if err != nil {
-		return 0, err
-	}
-	if durationSeconds < 0 {
-		return 0, errors.New("Input file has invalid duration")
-	}
-
-	return durationSeconds, nil
+	return info.Duration()
 }
 
 // ProcessVideoInput processes the video input.
-// The assumption is that all videos received are 1080p.
-// It is only required to resize once to 720p
-func ProcessVideoInput(input *os.File, contentType string) error {
-	// Before processing file, move reader to begining to avoid errors
-	input.Seek(0, 0)
+// The files produced are described by the video and thumbnail presets in the configuration.
+// Outputs selects the formats to produce and defaults to the configured outputs.
+func (p *Processor) ProcessVideoInput(ctx context.Context, input *os.File, contentType string, outputs ...string) error {
+	return p.ProcessVideoFile(ctx, input, contentType, generatePath("media/"), outputs...)
+}
 
-	destinationRoot := generatePath("media/")
-	var output1080 bytes.Buffer
-	var output720 bytes.Buffer
-	var outputThumb bytes.Buffer
+// ProcessVideoFile processes the video input like ProcessVideoInput and writes the outputs under destinationRoot
+func (p *Processor) ProcessVideoFile(ctx context.Context, input *os.File, contentType, destinationRoot string, outputs ...string) error {
+	if len(outputs) == 0 {
+		outputs = p.videoOutputs()
+	}
+	var checksum string
+	if p.Config.Dedup.Enabled {
+		var err error
+		checksum, err = fileChecksum(input)
+		if err != nil {
+			return err
+		}
+	}
+	return p.processVideo(ctx, nil, input, checksum, contentType, destinationRoot, outputs)
+}
 
-	err := completeRequest(&output1080, contentType, destinationRoot+"/1080.mp4")
-	if err != nil {
-		log.Println("File processing failed for 1080 video!")
+// processVideo writes the outputs of the video under destinationRoot and reports its progress to the job.
+// The outputs of an earlier upload with the same checksum are reused when deduplication is enabled.
+func (p *Processor) processVideo(ctx context.Context, job *Job, input *os.File, checksum, contentType, destinationRoot string, outputs []string) error {
+	reused, err := p.reuseOutputs(ctx, job, dedupMedia, checksum, destinationRoot, outputs)
+	if err != nil || reused {
 		return err
 	}
 
-	// Generate 720 video
-	err = startVideoProcess(input, &output720, VideoSizes["720p"])
+	// Before processing file, move reader to begining to avoid errors
+	input.Seek(0, 0)
+	stat, err := input.Stat()
 	if err != nil {
-		log.Println("File processing failed!")
 		return err
 	}
-	err = completeRequest(&output720, contentType, destinationRoot+"/720.mp4")
+	manifest := p.newManifest(job, destinationRoot)
+
+	job.setState(JobProbing)
+	info, duration, err := p.probeVideo(ctx, input)
 	if err != nil {
-		log.Println("File processing failed for 720 video!")
 		return err
 	}
-
+	if p.Config.Video.Metadata {
+		err = p.storeMetadata(ctx, manifest, info, destinationRoot)
+		if err != nil {
+			return err
+		}
+		job.addOutput(destinationRoot + "/metadata.json")
+	}
 	input.Seek(0, 0)
-	// Generate thumbnail
-	err = generateThumbnail(input, &outputThumb, "00:00:03")
+
+	source := &videoSource{file: input, contentType: contentType, info: info, duration: duration, checksum: checksum, size: stat.Size(), manifest: manifest}
+	err = p.generateVideoPresets(ctx, job, source, destinationRoot, outputs)
 	if err != nil {
 		return err
 	}
-	err = completeRequest(&outputThumb, http.DetectContentType(outputThumb.Bytes()), destinationRoot+"/thumb.png")
+
+	err = p.packageVideo(ctx, job, source, destinationRoot, outputs)
 	if err != nil {
-		log.Println("File processing failed for image!")
 		return err
 	}
+	return p.recordUpload(ctx, dedupMedia, checksum, destinationRoot, outputs)
+}
+
+// videoSource is an uploaded video with what is known about it.
+// key is the location of the upload in the input bucket, used to copy it without uploading it again, and may be empty.
+// checksum is empty when it was not computed, which only happens for uploads without a key.
+// Outputs are recorded in manifest as they complete.
+type videoSource struct {
+	file        *os.File
+	key         string
+	contentType string
+	info        *MediaInfo
+	duration    float64
+	checksum    string
+	size        int64
+	manifest    *manifestWriter
+}
+
+// generateVideoPresets writes the video presets and thumbnails of the video under destinationRoot.
+// Video presets are only produced when progressive MP4 is among the outputs.
+func (p *Processor) generateVideoPresets(ctx context.Context, job *Job, source *videoSource, destinationRoot string, outputs []string) error {
+	if hasVideoOutput(outputs, OutputMP4) {
+		for _, preset := range p.videoPresets() {
+			err := p.generateVideoPreset(ctx, job, source, preset, destinationRoot)
+			if err != nil {
+				log.Printf("File processing failed for %s video!", preset.Name)
+				return err
+			}
+		}
+	}
+
+	for _, preset := range p.thumbnailPresets() {
+		progress := "thumbnail/" + preset.Name
+		key := preset.key(destinationRoot)
+		job.setState(JobTranscoding)
+		job.setProgress(progress, 0)
+		opts := p.presetOptions(preset, source.contentType)
+		measure := newOutputMeasure()
+		err := p.streamRequest(ctx, opts, key, func(ctx context.Context, output io.Writer) error {
+			return p.generateThumbnailWithFile(ctx, *source.file, io.MultiWriter(output, measure), thumbnailTime(source.duration), preset, job.progressFunc(progress))
+		})
+		if err != nil {
+			log.Printf("File processing failed for %s thumbnail!", preset.Name)
+			return err
+		}
+		job.addOutput(key)
+		width, height := preset.Width, preset.Height
+		if width == 0 || height == 0 {
+			width, height = displaySize(source.info)
+		}
+		err = source.manifest.add(ctx, ManifestEntry{
+			Key: key, ContentType: opts.ContentType, Preset: preset.Name,
+			Width: width, Height: height, Size: measure.size, Checksum: measure.checksum(),
+		})
+		if err != nil {
+			return err
+		}
+		job.setProgress(progress, 100)
+	}
 
 	return nil
 }
 
-func generateThumbnail(input io.Reader, outputThumb io.Writer, time string) error {
-	cmd := exec.Command("ffmpeg",
-		"-ss", time, "-i", "pipe:0",
-		"-frames:v", "1",
-		"-f", "image2",
-		"-vf", fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease,pad=%s:%s:(ow-iw)/2:(oh-ih)/2", "600", "600", "600", "600"),
-		"pipe:1",
-	)
+func (p *Processor) generateVideoPreset(ctx context.Context, job *Job, source *videoSource, preset Preset, destinationRoot string) error {
+	key := preset.key(destinationRoot)
+	opts := p.presetOptions(preset, source.contentType)
+	entry := ManifestEntry{Key: key, ContentType: opts.ContentType, Preset: preset.Name, Duration: source.duration}
+	measure := newOutputMeasure()
+	var err error
+	if preset.Codec == PresetCopy {
+		job.setState(JobUploading)
+		entry.Width, entry.Height = displaySize(source.info)
+		if source.key != "" {
+			err = p.copyData(ctx, source.key, key, opts)
+			entry.Size, entry.Checksum = source.size, source.checksum
+		} else {
+			source.file.Seek(0, 0)
+			err = p.completeRequest(ctx, io.TeeReader(source.file, measure), opts, key)
+			entry.Size, entry.Checksum = measure.size, measure.checksum()
+		}
+	} else {
+		// The transcode is uploaded while it is encoded
+		job.setState(JobTranscoding)
+		job.setProgress(preset.Name, 0)
+		err = p.streamRequest(ctx, opts, key, func(ctx context.Context, output io.Writer) error {
+			return p.startVideoProcessWithFile(ctx, *source.file, io.MultiWriter(output, measure), preset, source.info, source.duration, job.progressFunc(preset.Name))
+		})
+		entry.Width, entry.Height = preset.videoSize(source.info)
+		entry.Size, entry.Checksum = measure.size, measure.checksum()
+	}
+	if err != nil {
+		return err
+	}
+	job.addOutput(key)
+	job.setProgress(preset.Name, 100)
+	return source.manifest.add(ctx, entry)
+}
+
+// thumbnailTime returns the position of thumbnails, the middle of the video or 3 seconds when the duration is unknown
+func thumbnailTime(duration float64) string {
+	if duration <= 0 {
+		return "00:00:03"
+	}
+	return strconv.FormatFloat(duration/2, 'f', 4, 64)
+}
 
-	err := ThumbnailCommand(cmd, input, outputThumb)
+// packageVideo produces the adaptive bitrate outputs requested for the video.
+// Progressive outputs are handled by the callers, since they differ between the server and lambda.
+// info is the probe result of the input, used for the rendition sizes and to report progress.
+func (p *Processor) packageVideo(ctx context.Context, job *Job, source *videoSource, destinationRoot string, outputs []string) error {
+	if !hasVideoOutput(outputs, OutputHLS) && !hasVideoOutput(outputs, OutputCMAF) {
+		return nil
+	}
+	input := source.file
+	input.Seek(0, 0)
+	renditions, err := PlanRenditions(source.info)
 	if err != nil {
-		log.Println(err.Error())
 		return err
 	}
+	duration := source.duration
+	if hasVideoOutput(outputs, OutputHLS) {
+		err = p.generateHLS(ctx, job, source.manifest, input, renditions, destinationRoot, duration)
+		if err != nil {
+			log.Println("File processing failed for HLS!")
+			return err
+		}
+	}
+	if hasVideoOutput(outputs, OutputCMAF) {
+		err = p.generateCMAF(ctx, job, source.manifest, input, renditions, len(source.info.Audio) > 0, destinationRoot, duration)
+		if err != nil {
+			log.Println("File processing failed for CMAF!")
+			return err
+		}
+	}
 
 	return nil
 }
 
-func generateThumbnailWithFile(input os.File, outputThumb io.Writer, time string, size Dimension) error {
-	cmd := exec.Command("ffmpeg",
-		"-ss", time, "-i", input.Name(),
-		"-frames:v", "1",
-		"-f", "image2",
-		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", size.width, size.height, size.width, size.height),
-		"pipe:1",
-	)
-	cmd.Stdout = outputThumb
-	err := cmd.Run()
+func (p *Processor) generateThumbnailWithFile(ctx context.Context, input os.File, outputThumb io.Writer, time string, preset Preset, onProgress ProgressFunc) error {
+	err := p.encodeStill(ctx, []string{"-ss", time, "-i", input.Name()}, "", nil, outputThumb, preset, onProgress)
 	if err != nil {
 		log.Printf("Failed to start thumbnail process")
 		return err
@@ -194,327 +277,241 @@ func generateThumbnailWithFile(input os.File, outputThumb io.Writer, time string
 
 // CreateVideoServer is used to process upload post request.
 // The desired workflow is to get the initial video data into a file and feed that file to the ffmpeg process.
-func CreateVideoServer(r *gin.Engine, config *Configuration) *gin.RouterGroup {
+// Uploads are processed in the background by the queue and the response carries the job which tracks them.
+func CreateVideoServer(r *gin.Engine, config *Configuration, queue *JobQueue) *gin.RouterGroup {
+	p := queue.processor
 	g := r.Group("/findapp")
 	g.POST("/gemform", func(c *gin.Context) {
-		//c.Request.ParseMultipartForm(config.MaxUploadSize)
-		rawFile, _, err := c.Request.FormFile("upload")
+		outputs, err := p.ParseVideoOutputs(c.Query("outputs"))
 		if err != nil {
-			log.Printf(err.Error())
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded data"})
+			respondError(c, err)
 			return
 		}
-		file, ok := rawFile.(*os.File)
-		if !ok {
+		c.Request.Body = p.limitBody(c)
+		rawFile, header, err := c.Request.FormFile("upload")
+		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded data"})
+			respondError(c, readError(err))
 			return
 		}
-		defer file.Close()
-		defer os.Remove(file.Name())
+		defer rawFile.Close()
 
-		buf := bufio.NewReaderSize(file, 600)
-		head, err := buf.Peek(512)
-		isVideoType, contentType := IsVideo(head)
-		if err != nil || (!filetype.IsVideo(head) && !isVideoType) {
-			if err != nil {
-				log.Printf(err.Error())
-			} else {
-				log.Printf("Not a video file")
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate stream"})
+		buf := bufio.NewReaderSize(rawFile, 600)
+		contentType, err := detectVideo(buf)
+		if err != nil {
+			log.Printf(err.Error())
+			respondError(c, err)
 			return
 		}
 
-		err = ProcessVideoInput(file, contentType)
+		// Save incoming file, the form file is removed once the request completes
+		file, checksum, err := queue.stageUpload(buf)
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
+		file.Close()
 
-		c.JSON(http.StatusOK, gin.H{"message": "Successfully processed data"})
-
+		job := NewVideoJob(header.Filename, file.Name(), contentType, outputs)
+		job.Checksum = checksum
+		acceptJob(c, queue, job)
 	})
 
 	g.POST("/gem", func(c *gin.Context) {
-		// Get uploaded file
-		reader := c.Request.Body
-		buf := bufio.NewReaderSize(reader, 600)
-		head, err := buf.Peek(512)
-		isVideoType, contentType := IsVideo(head)
-		if err != nil || (!filetype.IsVideo(head) && !isVideoType) {
-			if err != nil {
-				log.Printf(err.Error())
-			} else {
-				log.Printf("Not a video file")
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate stream"})
-			return
-		}
-		// Save incoming file
-		newFile, err := ioutil.TempFile("", "upload-*")
+		outputs, err := p.ParseVideoOutputs(c.Query("outputs"))
 		if err != nil {
-			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
-		defer newFile.Close()
-		defer os.Remove(newFile.Name())
-
-		// Write the current data to filesystem
-		_, err = buf.WriteTo(newFile)
+		// Get uploaded file
+		reader := p.limitBody(c)
 		defer reader.Close()
-
+		buf := bufio.NewReaderSize(reader, 600)
+		contentType, err := detectVideo(buf)
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
-		err = ProcessVideoInput(newFile, contentType)
+		// Save incoming file
+		newFile, checksum, err := queue.stageUpload(buf)
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
+		newFile.Close()
 
-		c.JSON(http.StatusOK, gin.H{"message": "Successfully processed data"})
+		job := NewVideoJob("", newFile.Name(), contentType, outputs)
+		job.Checksum = checksum
+		acceptJob(c, queue, job)
 	})
 
 	g.PATCH("/gem", func(c *gin.Context) {
-		rawFileKey, exists := c.GetQuery("url")
-		if !exists {
-
+		outputs, err := p.ParseVideoOutputs(c.Query("outputs"))
+		if err != nil {
+			respondError(c, err)
+			return
 		}
+		rawFileKey := c.Query("url")
 		sourceKey, err := url.QueryUnescape(rawFileKey)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Url must be provided"})
+		if err != nil || sourceKey == "" {
+			respondError(c, newError(ErrInvalidRequest, errors.New("Url must be provided")))
 			return
 		}
-		// Save incoming file
-		newFile, err := ioutil.TempFile("", "upload-*")
+		// Save incoming file, stopping if the client disconnects.
+		// The upload is not the request body, so its size is checked before it is downloaded.
+		ctx := c.Request.Context()
+		if p.Config.MaxUploadSize > 0 {
+			info, err := p.Store.Stat(ctx, p.Config.AWS.InputBucketName, sourceKey)
+			if err != nil {
+				respondError(c, err)
+				return
+			}
+			if info.Size > p.Config.MaxUploadSize {
+				respondError(c, ErrTooLarge)
+				return
+			}
+		}
+		newFile, err := queue.newUploadFile()
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			respondError(c, err)
 			return
 		}
 		defer newFile.Close()
-		defer os.Remove(newFile.Name())
 
-		err = downloadData(sourceKey, newFile, Config.AWS.InputBucketName)
+		checksum := newChecksum()
+		err = p.downloadData(ctx, sourceKey, io.MultiWriter(newFile, checksum), p.Config.AWS.InputBucketName)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse Url"})
+			os.Remove(newFile.Name())
+			respondError(c, err)
 			return
 		}
 
 		newFile.Seek(0, 0)
-		buf := bufio.NewReaderSize(newFile, 600)
-		head, err := buf.Peek(512)
-		isVideoType, contentType := IsVideo(head)
-		if err != nil || (!filetype.IsVideo(head) && !isVideoType) {
-			if err != nil {
-				log.Printf(err.Error())
-			} else {
-				log.Printf("Not a video file")
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate stream"})
-			return
-		}
-		err = ProcessVideoInput(newFile, contentType)
+		contentType, err := detectVideo(bufio.NewReaderSize(newFile, 600))
 		if err != nil {
 			log.Printf(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot proceed with processing due to internal error"})
+			os.Remove(newFile.Name())
+			respondError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Successfully processed data"})
+		job := NewVideoJob(sourceKey, newFile.Name(), contentType, outputs)
+		job.Checksum = checksumString(checksum)
+		acceptJob(c, queue, job)
 	})
 	return g
 }
 
-// HandleAWSMediaOld is called in lambda upon activity in a lambda
-func HandleAWSMediaOld(s3 events.S3Entity) error {
-	inputData := aws.NewWriteAtBuffer([]byte{})
-	fileKey, err := url.QueryUnescape(s3.Object.Key)
-	if err != nil {
-		return err
-	}
-
-	err = downloadData(fileKey, inputData, Config.AWS.InputBucketName)
-	if err != nil {
-		return err
+// detectVideo reads the head of the upload and returns its content type, or ErrNotMedia when it is not a video
+func detectVideo(buf *bufio.Reader) (string, error) {
+	head, err := buf.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", readError(err)
 	}
-
-	bytesRead := inputData.Bytes()
-	reader := bytes.NewReader(bytesRead[:])
-	head := bytesRead[:512]
 	isVideoType, contentType := IsVideo(head)
-	if err != nil || (!filetype.IsVideo(head) && !isVideoType) {
-		if err != nil {
-			return err
-		}
-		return errors.New("Cannot proceed with processing due to internal error")
-	}
-	destinationRoot := getMediaFilePath(fileKey)
-
-	// Copy root file to output bucket
-	err = copyData(fileKey, destinationRoot+"/1080.mp4", contentType)
-	if err != nil {
-		return err
-	}
-
-	var output720 bytes.Buffer
-	var outputThumb bytes.Buffer
-	err = startVideoProcess(reader, &output720, VideoSizes["720p"])
-	if err != nil {
-		return err
-	}
-	err = completeRequest(&output720, contentType, destinationRoot+"/720.mp4")
-	if err != nil {
-		return err
-	}
-
-	reader.Seek(0, 0)
-	err = generateThumbnail(reader, &outputThumb, "00:00:03")
-	if err != nil {
-		return err
-	}
-	err = completeRequest(&outputThumb, http.DetectContentType(outputThumb.Bytes()), destinationRoot+"/thumb.png")
-	if err != nil {
-		return err
+	if !filetype.IsVideo(head) && !isVideoType {
+		return "", ErrNotMedia
 	}
+	return contentType, nil
+}
 
-	return nil
+// HandleAWSMediaOld is called in lambda upon activity in a lambda.
+//
+// Deprecated: HandleAWSMediaOld processes the upload like HandleAWSMedia, which should be called instead.
+func (p *Processor) HandleAWSMediaOld(ctx context.Context, s3 events.S3Entity) error {
+	return p.HandleAWSMedia(ctx, s3)
 }
 
 // HandleAWSMedia is called in lambda upon activity in a lambda
-func HandleAWSMedia(s3 events.S3Entity) error {
-	inputData := aws.NewWriteAtBuffer([]byte{})
+func (p *Processor) HandleAWSMedia(ctx context.Context, s3 events.S3Entity) error {
 	fileKey, err := url.QueryUnescape(s3.Object.Key)
 	if err != nil {
 		return err
 	}
 
-	// Download the uploaded data from S3
-	err = downloadData(fileKey, inputData, Config.AWS.InputBucketName)
-	if err != nil {
-		return err
-	}
-
 	// Create a temp file which will be used for storing the video.
 	// This is because tests proved that ffmpeg processes files better than streams.
+	// The upload is downloaded straight into it, so the size of videos is not limited by memory.
 	tempFile, err := ioutil.TempFile("", "upload-*.mp4")
 	if err != nil {
 		return err
 	}
-	bytesRead := inputData.Bytes()
-	err = ioutil.WriteFile(tempFile.Name(), bytesRead, 0666)
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// Download the uploaded data from S3
+	checksum := newChecksum()
+	err = p.downloadData(ctx, fileKey, io.MultiWriter(tempFile, checksum), p.Config.AWS.InputBucketName)
 	if err != nil {
 		return err
 	}
 
 	// Test if input is actually a video file
-	head := bytesRead[:512]
-	isVideoType, contentType := IsVideo(head)
-	if err != nil || (!filetype.IsVideo(head) && !isVideoType) {
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Cannot proceed with processing due to internal error, %v", err)
-		// If file is not a video, do not return an error to prevent lambda from being rerun.
-		return nil
-	}
-	reader := bytes.NewReader(bytesRead[:])
-	rawDuration, err := GetDuration(reader)
-	if err != nil {
+	head := make([]byte, 512)
+	n, err := tempFile.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
 		return err
 	}
-	inputData = nil
-	duration := strconv.FormatFloat((rawDuration / 2), 'f', 4, 64)
+	head = head[:n]
+	isVideoType, contentType := IsVideo(head)
+	if !filetype.IsVideo(head) && !isVideoType {
+		return newError(ErrNotMedia, fmt.Errorf("%s is not a video", fileKey))
+	}
 	destinationRoot := getMediaFilePath(fileKey)
-
-	// Copy root file to output bucket
-	err = copyData(fileKey, destinationRoot+"/1080.mp4", contentType)
-	if err != nil {
+	outputs := p.videoOutputs()
+	reused, err := p.reuseOutputs(ctx, nil, dedupMedia, checksumString(checksum), destinationRoot, outputs)
+	if err != nil || reused {
 		return err
 	}
 
-	// For each output, create a buffer and save the converted data.
-	//var output720 bytes.Buffer
-	var outputThumb bytes.Buffer
-
-	// TEMPORARILY STOP CONVERSION TO REDUCE LATENCY
-	// Generate resized video for 720p --- START
-	/*
-		err = startVideoProcessWithFile(*tempFile, &output720, VideoSizes["720p"])
-		if err != nil {
-			return err
-		}
-		err = completeRequest(&output720, contentType, destinationRoot+"/720.mp4")
-		if err != nil {
-			return err
-		}
-	*/
-	// 720p --- END
-
-	// Generate thumbnails
-	// 1080 --- START
-	err = generateThumbnailWithFile(*tempFile, &outputThumb, duration, VideoSizes["1080p"])
+	info, rawDuration, err := p.probeVideo(ctx, tempFile)
 	if err != nil {
 		return err
 	}
-	imageType := http.DetectContentType(outputThumb.Bytes())
-	err = completeRequest(&outputThumb, imageType, destinationRoot+"/1080.jpg")
+	stat, err := tempFile.Stat()
 	if err != nil {
 		return err
 	}
-	// 1080 --- END
+	manifest := p.newManifest(nil, destinationRoot)
+	if p.Config.Video.Metadata {
+		err = p.storeMetadata(ctx, manifest, info, destinationRoot)
+		if err != nil {
+			return err
+		}
+	}
 
-	// 720 --- START
-	// Reuse buffer
-	outputThumb.Reset()
-	err = generateThumbnailWithFile(*tempFile, &outputThumb, duration, VideoSizes["720p"])
-	if err != nil {
-		return err
+	source := &videoSource{
+		file: tempFile, key: fileKey, contentType: contentType, info: info, duration: rawDuration,
+		checksum: checksumString(checksum), size: stat.Size(), manifest: manifest,
 	}
-	err = completeRequest(&outputThumb, imageType, destinationRoot+"/720.jpg")
+	err = p.generateVideoPresets(ctx, nil, source, destinationRoot, outputs)
 	if err != nil {
 		return err
 	}
-	// 720 --- END
-
-	return nil
-}
 
-func startVideoProcess(input io.Reader, outputVideo io.Writer, d Dimension) error {
-	width, height := strconv.Itoa(d.width), strconv.Itoa(d.height)
-	cmd := exec.Command("ffmpeg",
-		"-i", "pipe:0",
-		"-movflags", "frag_keyframe+empty_moov", "-f", "mp4",
-		"-vf", fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease,pad=%s:%s:(ow-iw)/2:(oh-ih)/2", width, height, width, height),
-		"pipe:1",
-	)
-
-	err := VideoResizeCommand(cmd, input, outputVideo)
+	// Package adaptive bitrate streams
+	err = p.packageVideo(ctx, nil, source, destinationRoot, outputs)
 	if err != nil {
-		log.Println("File processing failed!")
 		return err
 	}
-
-	return nil
+	return p.recordUpload(ctx, dedupMedia, source.checksum, destinationRoot, outputs)
 }
 
-func startVideoProcessWithFile(input os.File, outputVideo io.Writer, d Dimension) error {
-	width, height := strconv.Itoa(d.width), strconv.Itoa(d.height)
-	cmd := exec.Command("ffmpeg",
-		"-i", input.Name(),
-		"-movflags", "frag_keyframe+empty_moov", "-f", "mp4",
-		"-vf", fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease,pad=%s:%s:(ow-iw)/2:(oh-ih)/2", width, height, width, height),
-		"pipe:1",
-	)
+// startVideoProcessWithFile encodes the video with the preset
+func (p *Processor) startVideoProcessWithFile(ctx context.Context, input os.File, outputVideo io.Writer, preset Preset, info *MediaInfo, duration float64, onProgress ProgressFunc) error {
+	args := []string{"-i", input.Name()}
+	if filter := preset.videoFilter(info); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	args = append(args, preset.encoderArgs()...)
+	cmd := p.Encoder.Command(ctx, "ffmpeg", append(args, "pipe:1")...)
 
 	cmd.Stdout = outputVideo
-	err := cmd.Run()
+	err := runCommand(ctx, cmd, duration, onProgress)
 	if err != nil {
 		log.Println("File processing failed!")
 		return err
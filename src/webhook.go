@@ -0,0 +1,306 @@
+package vod
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// WebhookJobAccepted is sent when an upload is accepted for processing
+	WebhookJobAccepted = "job.accepted"
+	// WebhookRenditionCompleted is sent when an output produced by a preset or a packaging format is stored
+	WebhookRenditionCompleted = "rendition.completed"
+	// WebhookJobCompleted is sent when every output of an upload is stored
+	WebhookJobCompleted = "job.completed"
+	// WebhookJobFailed is sent when an upload could not be processed
+	WebhookJobFailed = "job.failed"
+
+	defaultWebhookRetries = 3
+	defaultWebhookBackoff = time.Second
+	defaultWebhookTimeout = 10 * time.Second
+	// webhookQueueSize is the number of events kept for a target while earlier ones are delivered
+	webhookQueueSize = 256
+)
+
+// WebhookTarget is an endpoint notified of job events.
+// Events lists the event types sent to the endpoint, every type when it is empty.
+// Secret signs the body of each event, see Webhooks.
+type WebhookTarget struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Validate checks that the target has an absolute URL and only known event types
+func (t WebhookTarget) Validate() error {
+	endpoint, err := url.Parse(t.URL)
+	if err != nil || !endpoint.IsAbs() {
+		return fmt.Errorf("Webhook URL(%s) is not absolute", t.URL)
+	}
+	for _, event := range t.Events {
+		switch event {
+		case WebhookJobAccepted, WebhookRenditionCompleted, WebhookJobCompleted, WebhookJobFailed:
+		default:
+			return fmt.Errorf("Unknown webhook event(%s)", event)
+		}
+	}
+	return nil
+}
+
+func (t WebhookTarget) accepts(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, accepted := range t.Events {
+		if accepted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body sent to webhook targets.
+// JobID is empty for uploads processed by lambda, which are identified by InputKey.
+// Output describes the stored output of rendition events, and Manifest locates the manifest of completed uploads.
+// ID is kept when a delivery is retried, so targets can ignore events they already received.
+type WebhookEvent struct {
+	ID          string         `json:"id"`
+	Type        string         `json:"type"`
+	JobID       string         `json:"jobId,omitempty"`
+	Root        string         `json:"root"`
+	InputKey    string         `json:"inputKey,omitempty"`
+	Output      *ManifestEntry `json:"output,omitempty"`
+	Manifest    string         `json:"manifest,omitempty"`
+	DuplicateOf string         `json:"duplicateOf,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	ErrorCode   string         `json:"errorCode,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
+func newWebhookEvent(eventType, root string) *WebhookEvent {
+	return &WebhookEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Root:      root,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Webhooks delivers events to the configured targets in the background.
+// Each target receives its events in order. Every request carries the event type in X-Vod-Event, the event ID in
+// X-Vod-Delivery and the hex HMAC-SHA256 of the body keyed with the target secret as "sha256=<hex>" in X-Vod-Signature.
+// Deliveries which fail with a network error, 429 or a 5xx status are retried with exponential backoff.
+// A nil Webhooks sends nothing.
+type Webhooks struct {
+	targets []*webhookWorker
+	pending sync.WaitGroup
+	start   sync.Once
+}
+
+// webhookWorker delivers the events of a single target
+type webhookWorker struct {
+	target  WebhookTarget
+	queue   chan *webhookDelivery
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+type webhookDelivery struct {
+	event *WebhookEvent
+	body  []byte
+}
+
+// NewWebhooks returns the webhooks of the configuration, or nil when no target is configured.
+// Targets are delivered to once the first event is sent.
+func NewWebhooks(config *Configuration) *Webhooks {
+	settings := config.Webhooks
+	if len(settings.Targets) == 0 {
+		return nil
+	}
+	retries, backoff, timeout := settings.Retries, time.Duration(settings.Backoff)*time.Millisecond, time.Duration(settings.Timeout)*time.Second
+	if retries <= 0 {
+		retries = defaultWebhookRetries
+	}
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	w := &Webhooks{}
+	for _, target := range settings.Targets {
+		w.targets = append(w.targets, &webhookWorker{
+			target:  target,
+			queue:   make(chan *webhookDelivery, webhookQueueSize),
+			client:  &http.Client{Timeout: timeout},
+			retries: retries,
+			backoff: backoff,
+		})
+	}
+	return w
+}
+
+// Send queues the event for every target which accepts its type.
+// Events are dropped when a target has too many events waiting.
+func (w *Webhooks) Send(event *WebhookEvent) {
+	if w == nil {
+		return
+	}
+	w.start.Do(func() {
+		for _, worker := range w.targets {
+			go worker.work(&w.pending)
+		}
+	})
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode webhook event %s: %s", event.ID, err.Error())
+		return
+	}
+	for _, worker := range w.targets {
+		if !worker.target.accepts(event.Type) {
+			continue
+		}
+		w.pending.Add(1)
+		select {
+		case worker.queue <- &webhookDelivery{event: event, body: body}:
+		default:
+			w.pending.Done()
+			log.Printf("Dropped webhook event %s(%s) for %s, too many events are waiting", event.ID, event.Type, worker.target.URL)
+		}
+	}
+}
+
+// Wait blocks until every queued event was delivered or given up on, or the context is done.
+// Lambda waits before returning, as it may be frozen once the handler returns.
+func (w *Webhooks) Wait(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *webhookWorker) work(pending *sync.WaitGroup) {
+	for delivery := range w.queue {
+		err := w.deliver(delivery)
+		if err != nil {
+			log.Printf("Failed to deliver webhook event %s(%s) to %s: %s", delivery.event.ID, delivery.event.Type, w.target.URL, err.Error())
+		}
+		pending.Done()
+	}
+}
+
+// deliver posts the event, retrying failures which may succeed later
+func (w *webhookWorker) deliver(delivery *webhookDelivery) error {
+	backoff := w.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = w.post(delivery)
+		if err == nil || !retry || attempt == w.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends the event once and reports whether a failure should be retried
+func (w *webhookWorker) post(delivery *webhookDelivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.target.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vod-Event", delivery.event.Type)
+	req.Header.Set("X-Vod-Delivery", delivery.event.ID)
+	req.Header.Set("X-Vod-Signature", "sha256="+WebhookSignature(w.target.Secret, delivery.body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Webhook responded with %s", res.Status)
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
+
+// WebhookSignature returns the hex HMAC-SHA256 of the body keyed with the secret, as sent in X-Vod-Signature
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyJob sends the event of a job received by the server
+func (p *Processor) notifyJob(eventType string, job *Job) {
+	if p.Webhooks == nil {
+		return
+	}
+	snapshot := job.Snapshot()
+	event := newWebhookEvent(eventType, job.destinationRoot())
+	event.JobID, event.InputKey = snapshot.ID, snapshot.InputKey
+	switch eventType {
+	case WebhookJobCompleted:
+		event.Manifest = event.Root + "/" + manifestName
+		event.DuplicateOf = snapshot.DuplicateOf
+	case WebhookJobFailed:
+		event.Error, event.ErrorCode = snapshot.Error, snapshot.ErrorCode
+	}
+	p.Webhooks.Send(event)
+}
+
+// NotifyUpload sends the event of an upload processed outside the job queue, such as by lambda.
+// key is the location of the upload in the input bucket and err is the cause of failure of WebhookJobFailed events.
+func (p *Processor) NotifyUpload(eventType, key string, err error) {
+	if p.Webhooks == nil {
+		return
+	}
+	if unescaped, unescapeErr := url.QueryUnescape(key); unescapeErr == nil {
+		key = unescaped
+	}
+	root := ""
+	if strings.Count(key, "/") > 0 {
+		root = getMediaFilePath(key)
+		if strings.HasPrefix(key, p.Config.AWS.CataloguePrefixName) {
+			root = getCatalogueFilePath(key)
+		}
+	}
+	event := newWebhookEvent(eventType, root)
+	event.InputKey = key
+	switch eventType {
+	case WebhookJobCompleted:
+		event.Manifest = root + "/" + manifestName
+	case WebhookJobFailed:
+		event.Error, event.ErrorCode = err.Error(), ErrorCode(err)
+	}
+	p.Webhooks.Send(event)
+}
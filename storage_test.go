@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "vod-storage-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	store, err := vod.NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put(ctx, "input", "media/abc/upload.mp4", strings.NewReader("video data"), vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Copy(ctx, "input", "media/abc/upload.mp4", "output", "media/abc/1080.mp4", vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := store.Get(ctx, "output", "media/abc/1080.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "video data" {
+		t.Errorf("Unexpected copied data %q, %v", data, err)
+	}
+
+	info, err := store.Stat(ctx, "output", "media/abc/1080.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("video data")) || info.ContentType != "video/mp4" {
+		t.Errorf("Unexpected object info %+v", info)
+	}
+
+	objects, err := store.List(ctx, "output", "media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "media/abc/1080.mp4" {
+		t.Errorf("Unexpected listing %+v", objects)
+	}
+
+	err = store.Delete(ctx, "output", "media/abc/1080.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get(ctx, "output", "media/abc/1080.mp4")
+	if err != vod.ErrObjectNotFound {
+		t.Errorf("Expected object to be deleted, got %v", err)
+	}
+
+	_, err = store.Get(ctx, "output", "../input/media/abc/upload.mp4")
+	if err != vod.ErrObjectNotFound {
+		t.Errorf("Expected keys to stay inside the bucket, got %v", err)
+	}
+	for _, bucket := range []string{"..", ".", "", "output/..", `..\input`} {
+		if _, err = store.Get(ctx, bucket, "media/abc/upload.mp4"); err == nil {
+			t.Errorf("Expected bucket %q to be rejected by Get", bucket)
+		}
+		if err = store.Put(ctx, bucket, "escaped.txt", strings.NewReader("data"), vod.PutOptions{}); err == nil {
+			t.Errorf("Expected bucket %q to be rejected by Put", bucket)
+		}
+		if _, err = store.List(ctx, bucket, ""); err == nil {
+			t.Errorf("Expected bucket %q to be rejected by List", bucket)
+		}
+	}
+}
+
+func TestS3Copy(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.Write([]byte(`<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`))
+	}))
+	defer server.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := vod.NewS3Storage(sess)
+	ctx := context.Background()
+
+	err = store.Copy(ctx, "input", "media/abc/my video+1.mp4", "output", "media/abc/original.mp4", vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Copy(ctx, "input", "media/abc/original.mp4", "output", "media/def/original.mp4", vod.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 copies, got %d", len(requests))
+	}
+	header := requests[0].Header
+	if source := header.Get("X-Amz-Copy-Source"); source != "input/media/abc/my%20video%2B1.mp4" {
+		t.Errorf("Expected the copy source to be escaped, got %s", source)
+	}
+	if header.Get("X-Amz-Metadata-Directive") != "REPLACE" || header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("Expected the content type to replace the metadata of the source, got %v", header)
+	}
+	if directive := requests[1].Header.Get("X-Amz-Metadata-Directive"); directive != "" {
+		t.Errorf("Expected copies without a content type to keep the metadata of the source, got %s", directive)
+	}
+}
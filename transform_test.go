@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+func TestImageTransforms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-transform-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+	config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "jpg"}}
+	config.Transform.Secret = "secret"
+	config.Transform.Allowed = []vod.ImageTransform{{Width: 50, Height: 50, Fit: vod.ResizeFill}}
+
+	source := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(source, source.Bounds(), image.NewUniform(color.RGBA{G: 255, A: 255}), image.Point{}, draw.Src)
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = processor.ProcessImageInput(ctx, bytes.NewReader(encoded.Bytes()), "image/png", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache only fits a single image, and leaves files it did not write alone
+	cacheDir := filepath.Join(dir, "cache")
+	unrelated := []string{filepath.Join(cacheDir, "notes.txt"), filepath.Join(cacheDir, "transforms", "notes.txt")}
+	for _, name := range unrelated {
+		err = os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(name, bytes.Repeat([]byte("note"), 1000), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, err := vod.NewImageCache(cacheDir, 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	processor.CreateTransformServer(r, cache)
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	allowed := get("/findapp/img/abc?w=50&h=50&fit=fill", nil)
+	if allowed.Code != http.StatusOK || allowed.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected the allowed transform as PNG, got %d %s", allowed.Code, allowed.Body.String())
+	}
+	if config, err := png.DecodeConfig(bytes.NewReader(allowed.Body.Bytes())); err != nil || config.Width != 50 || config.Height != 50 {
+		t.Errorf("Expected a 50x50 image, got %+v %v", config, err)
+	}
+	etag := allowed.Header().Get("ETag")
+	if etag == "" || allowed.Header().Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("Unexpected cache headers %v", allowed.Header())
+	}
+	if cached := get("/findapp/img/abc?w=50&h=50&fit=fill", http.Header{"If-None-Match": {etag}}); cached.Code != http.StatusNotModified {
+		t.Errorf("Expected a matching ETag to be revalidated, got %d", cached.Code)
+	}
+
+	// Images removed from the cache directory are transformed again
+	removed := filepath.Join(cacheDir, "transforms", strings.Trim(etag, `"`))
+	err = os.Remove(removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := get("/findapp/img/abc?w=50&h=50&fit=fill", nil); again.Code != http.StatusOK || !bytes.Equal(again.Body.Bytes(), allowed.Body.Bytes()) {
+		t.Errorf("Expected the removed image to be transformed again, got %d", again.Code)
+	}
+	if _, err := os.Stat(removed); err != nil {
+		t.Errorf("Expected the removed image to be cached again, got %v", err)
+	}
+
+	// Cached images are served without reading the original again
+	err = store.Put(ctx, config.AWS.OutputBucketName, "catalogue/abc/original.png", strings.NewReader("broken"), vod.PutOptions{ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := get("/findapp/img/abc?h=50&fit=fill&w=50", nil); again.Code != http.StatusOK || !bytes.Equal(again.Body.Bytes(), allowed.Body.Bytes()) {
+		t.Errorf("Expected the transform to be cached, got %d", again.Code)
+	}
+	err = store.Put(ctx, config.AWS.OutputBucketName, "catalogue/abc/original.png", bytes.NewReader(encoded.Bytes()), vod.PutOptions{ContentType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if denied := get("/findapp/img/abc?w=60&h=30", nil); denied.Code != http.StatusForbidden {
+		t.Errorf("Expected transforms which are not allowed to be rejected, got %d", denied.Code)
+	}
+	signed := processor.SignImageURL("abc", vod.ImageTransform{Width: 60, Height: 30, Fit: vod.ResizeStretch, Format: "jpg", Quality: 80})
+	if tampered := get(strings.Replace(signed, "w=60", "w=61", 1), nil); tampered.Code != http.StatusForbidden {
+		t.Errorf("Expected a tampered signature to be rejected, got %d", tampered.Code)
+	}
+	response := get(signed, nil)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected the signed transform as JPEG, got %d %s", response.Code, response.Body.String())
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(response.Body.Bytes())); err != nil || config.Width != 60 || config.Height != 30 {
+		t.Errorf("Expected a 60x30 image, got %+v %v", config, err)
+	}
+	if response.Header().Get("ETag") == etag {
+		t.Errorf("Expected transforms to have their own ETag")
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheDir, "transforms", "*[0-9a-f]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || "\""+filepath.Base(files[0])+"\"" != response.Header().Get("ETag") {
+		t.Errorf("Expected the least recently used image to be evicted, got %d cached", len(files))
+	}
+	for _, name := range unrelated {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+	}
+	if missing := get("/findapp/img/def?w=50&h=50&fit=fill", nil); missing.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown images to be missing, got %d", missing.Code)
+	}
+}
+
+// slowStorage counts reads of a key, which take a while so that requests for it overlap
+type slowStorage struct {
+	vod.Storage
+	key   string
+	reads int32
+}
+
+func (s *slowStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	if key == s.key {
+		atomic.AddInt32(&s.reads, 1)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return s.Storage.Get(ctx, bucket, key)
+}
+
+func TestImageTransformMisses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-transform-misses-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	processor.Encoder = vod.CommandEncoder{FFmpegPath: "/bin/false", FFprobePath: "/bin/false"}
+	processor.Config.Presets.Images = []vod.Preset{{Name: "original", Codec: vod.PresetCopy, Container: "jpg"}}
+	processor.Config.Transform.Allowed = []vod.ImageTransform{{Width: 50, Height: 50}}
+
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 200, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ProcessImageInput(context.Background(), &encoded, "image/png", "catalogue/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowStorage{Storage: store, key: "catalogue/abc/original.png"}
+	processor.Store = slow
+	cache, err := vod.NewImageCache(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	processor.CreateTransformServer(r, cache)
+
+	// Concurrent requests for an image which is not cached yet transform it once
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/findapp/img/abc?w=50&h=50", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected every request to be served, got %v", codes)
+			break
+		}
+	}
+	if reads := atomic.LoadInt32(&slow.reads); reads != 1 {
+		t.Errorf("Expected the image to be transformed once, got %d", reads)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/gin-gonic/gin"
+)
+
+func TestTusUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-tus-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, _ := newTestProcessor(t, dir)
+	processor.Config.Jobs.Path = ""
+	queue, err := processor.NewJobQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := vod.NewTusStore(filepath.Join(dir, "tus"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	vod.CreateTusServer(r, queue, store)
+
+	send := func(method, target string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	patch := func(target string, offset int, body string) *httptest.ResponseRecorder {
+		return send(http.MethodPatch, target, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, body)
+	}
+
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	w := send(http.MethodPost, "/findapp/tus", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(video)),
+		"Upload-Metadata": "filename dmlkZW8ubXA0",
+	}, "")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") == "" {
+		t.Fatalf("Expected upload to be created, got %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+
+	w = patch(location, 0, video[:300])
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "300" {
+		t.Fatalf("Expected first chunk to be accepted, got %d with offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = send(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "300" || w.Header().Get("Upload-Metadata") != "filename dmlkZW8ubXA0" {
+		t.Fatalf("Unexpected upload status %d with offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = patch(location, 0, video[:300])
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected chunk at the wrong offset to conflict, got %d", w.Code)
+	}
+
+	w = patch(location, 300, video[300:])
+	if w.Code != http.StatusNoContent || w.Header().Get("Job-Id") == "" {
+		t.Fatalf("Expected completed upload to be queued, got %d", w.Code)
+	}
+	if _, ok := queue.Get(w.Header().Get("Job-Id")); !ok {
+		t.Error("Expected job of the completed upload to exist")
+	}
+	w = send(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected completed upload to be handed over, got %d", w.Code)
+	}
+
+	// Termination
+	w = send(http.MethodPost, "/findapp/tus", map[string]string{"Upload-Length": "10"}, "")
+	location = w.Header().Get("Location")
+	w = send(http.MethodDelete, location, nil, "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected upload to be terminated, got %d", w.Code)
+	}
+	w = send(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected terminated upload to be missing, got %d", w.Code)
+	}
+	for _, path := range []string{location, "/findapp/tus/unknown"} {
+		if w = patch(path, 0, "data"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected chunk of a missing upload to be rejected, got %d", w.Code)
+		}
+		if w = send(http.MethodDelete, path, nil, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected termination of a missing upload to be rejected, got %d", w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/findapp/tus", nil)
+	req.Header.Set("Upload-Length", "10")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected request without Tus-Resumable to be rejected, got %d", w.Code)
+	}
+}
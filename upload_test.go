@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	vod "eikcalb.dev/vod/src"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gin-gonic/gin"
+)
+
+// presignedStorage issues fixed forms on top of local storage
+type presignedStorage struct {
+	*vod.LocalStorage
+}
+
+func (s presignedStorage) PresignUpload(ctx context.Context, bucket, key string, maxSize int64, opts vod.PutOptions, expires time.Duration) (*vod.UploadForm, error) {
+	return &vod.UploadForm{URL: "https://uploads.test/" + bucket, Fields: map[string]string{"key": key}}, nil
+}
+
+func TestDirectUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-uploads-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := vod.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := vod.LoadConfig("config.json")
+	config.MaxUploadSize = 1000
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	vod.NewProcessor(config, presignedStorage{local}, nil).CreateUploadServer(r)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/findapp/uploads", strings.NewReader(body)))
+		return w
+	}
+
+	w := send(`{"contentType": "video/mp4", "size": 500}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected upload to be issued, got %d", w.Code)
+	}
+	upload := vod.DirectUpload{}
+	err = json.Unmarshal(w.Body.Bytes(), &upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Key != "media/"+upload.MediaID+"/upload" || upload.Root != "media/"+upload.MediaID || upload.Fields["key"] != upload.Key {
+		t.Errorf("Unexpected upload %+v", upload)
+	}
+
+	w = send(`{"contentType": "image/jpeg", "size": 500}`)
+	err = json.Unmarshal(w.Body.Bytes(), &upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(upload.Key, "catalogue/") {
+		t.Errorf("Expected image to be uploaded to the catalogue, got %s", upload.Key)
+	}
+
+	if w = send(`{"contentType": "video/mp4", "size": 5000}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected large upload to be rejected, got %d", w.Code)
+	}
+	if w = send(`{"contentType": "text/plain", "size": 500}`); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected text upload to be rejected, got %d", w.Code)
+	}
+
+	r = gin.New()
+	vod.NewProcessor(config, local, nil).CreateUploadServer(r)
+	if w = send(`{"contentType": "video/mp4", "size": 500}`); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected storage without presigning to be rejected, got %d", w.Code)
+	}
+}
+
+func TestS3PresignUpload(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		Region:      aws.String("us-east-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := vod.NewS3Storage(sess).PresignUpload(context.Background(), "input", "media/abc/upload", 500, vod.PutOptions{ContentType: "video/mp4"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(form.URL, "/input") || form.Fields["x-amz-signature"] == "" || form.Fields["Content-Type"] != "video/mp4" {
+		t.Errorf("Unexpected form %+v", form)
+	}
+	policy, err := base64.StdEncoding.DecodeString(form.Fields["policy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(policy, []byte(`["content-length-range",1,500]`)) {
+		t.Errorf("Expected policy to limit the size, got %s", policy)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -11,11 +12,14 @@ func TestVideoResize(t *testing.T) {
 	filename := "upload.mp4"
 	t.Log("Starting video resize test")
 	file, err := os.OpenFile(filename, os.O_RDONLY, os.ModePerm)
+	if os.IsNotExist(err) {
+		t.Skipf("Test input %s is not available", filename)
+	}
 	defer file.Close()
 	if err != nil {
 		t.Error(err.Error())
 	}
-	err = vod.ProcessVideoInput(file, "video/mp4")
+	err = vod.ProcessVideoInput(context.Background(), file, "video/mp4")
 	if err != nil {
 		t.Error(err.Error())
 	} else {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	vod "eikcalb.dev/vod/src"
+)
+
+func TestWebhooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod-webhooks-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor, store := newTestProcessor(t, dir)
+	config := processor.Config
+
+	// The first delivery fails and has to be retried
+	var mu sync.Mutex
+	var received []vod.WebhookEvent
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Vod-Signature") != "sha256="+vod.WebhookSignature("secret", body) {
+			t.Errorf("Unexpected signature %s", r.Header.Get("X-Vod-Signature"))
+		}
+		event := vod.WebhookEvent{}
+		err := json.Unmarshal(body, &event)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Vod-Event") != event.Type {
+			t.Errorf("Expected event header %s, got %s", event.Type, r.Header.Get("X-Vod-Event"))
+		}
+		received = append(received, event)
+	}))
+	defer server.Close()
+	config.Webhooks.Targets = []vod.WebhookTarget{{URL: server.URL, Secret: "secret"}}
+	config.Webhooks.Backoff = 1
+	processor.Webhooks = vod.NewWebhooks(config)
+
+	ctx := context.Background()
+	video := "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 600)
+	err = store.Put(ctx, config.AWS.InputBucketName, "media/abc/upload.mp4", strings.NewReader(video), vod.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := events.S3EventRecord{}
+	record.S3.Bucket.Name = config.AWS.InputBucketName
+	record.S3.Object.Key = "media/abc/upload.mp4"
+	err = setupLambda(ctx, processor, events.S3Event{Records: []events.S3EventRecord{record}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lambda returns once every event was delivered
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) < 3 {
+		t.Fatalf("Expected accepted, rendition and completed events, got %+v", received)
+	}
+	first, last := received[0], received[len(received)-1]
+	if first.Type != vod.WebhookJobAccepted || last.Type != vod.WebhookJobCompleted {
+		t.Errorf("Expected events from acceptance to completion, got %s and %s", first.Type, last.Type)
+	}
+	if last.Root != "media/abc" || last.Manifest != "media/abc/manifest.json" {
+		t.Errorf("Unexpected completed event %+v", last)
+	}
+	renditions := map[string]bool{}
+	for _, event := range received[1 : len(received)-1] {
+		if event.Type != vod.WebhookRenditionCompleted || event.Output == nil {
+			t.Errorf("Unexpected event %+v", event)
+			continue
+		}
+		renditions[event.Output.Key] = true
+	}
+	for _, key := range []string{"media/abc/1080.mp4", "media/abc/720.mp4", "media/abc/thumb.png"} {
+		if !renditions[key] {
+			t.Errorf("Expected rendition event for %s", key)
+		}
+	}
+}